@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	log "unknwon.dev/clog/v2"
 
@@ -31,36 +32,6 @@ type CalypsoFirewall struct {
 	*wf.WebauthnFirewall
 }
 
-func userIDFromSession(r *http.Request) (int64, error) {
-	// Get the UserID associated with the sessionID in the cookies. This is to assure that the
-	// server and the firewall are referencing the same user during the webauthn check
-	apiHost := "https://public-api.wordpress.com"
-	url := fmt.Sprintf("%s/rest/v1.1/me", apiHost)
-	userIDReq, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, err
-	}
-
-	// Pass on the Authorization header from `r` to `userIDReq`
-	authorizationString := r.Header.Get("Authorization")
-	userIDReq.Header.Set("Authorization", authorizationString)
-
-	for _, cookie := range r.Cookies() {
-		userIDReq.AddCookie(cookie)
-	}
-
-	var sessionInfo struct {
-		UserID int64 `json:"ID"`
-	}
-	err = tool.PerformRequestJSON(userIDReq, &sessionInfo)
-	if err != nil {
-		return 0, err
-	}
-
-	// Success!
-	return sessionInfo.UserID, nil
-}
-
 func languageFromID(args ...interface{}) (interface{}, error) {
 	// Sanity check the input
 	if len(args) != 1 {
@@ -145,7 +116,7 @@ func (firewall *CalypsoFirewall) finishLogin(w http.ResponseWriter, r *wf.Extend
 			}
 
 			// See if the user has webauthn enabled
-			isEnabled := db.WebauthnStore.IsUserEnabled(db.QueryByUsername(username))
+			isEnabled := firewall.Store().IsUserEnabled(db.QueryByUsername(username))
 
 			// Perform a webauthn check if webauthn is enabled for this user
 			if isEnabled {
@@ -171,7 +142,18 @@ func (firewall *CalypsoFirewall) finishLogin(w http.ResponseWriter, r *wf.Extend
 }
 
 func main() {
-	// TODO: Add a flag to fall through (use / as a catch all) or not
+	// Resolve the userID of the session from the wordpress API
+	identityProvider, err := wf.NewBackendIdentityProvider(wf.BackendIdentityConfig{
+		URL:            "https://public-api.wordpress.com/rest/v1.1/me",
+		ForwardCookies: true,
+		ForwardHeaders: []string{"Authorization"},
+		UserIDPath:     "ID",
+		CacheTTL:       30 * time.Second,
+	})
+	if err != nil {
+		log.Fatal("Unable to create identity provider: %v", err)
+	}
+
 	firewallConfigs := &wf.WebauthnFirewallConfig{
 		RPDisplayName: "Foobar Corp.",
 		RPID:          "calypso.localhost",
@@ -180,7 +162,7 @@ func main() {
 		ReverseProxyTargetMap: reverseProxyTargetMap,
 		ReverseProxyAddress:   reverseProxyAddress,
 
-		GetUserID: userIDFromSession,
+		IdentityProvider: identityProvider,
 		ContextGetters: wf.ContextGettersType{
 			"language":        languageFromID,
 			"privacy_setting": privacySettingFromID,
@@ -191,6 +173,10 @@ func main() {
 		LoginURL:           "", // Use a custom `finishLogin` function
 		LoginGetUsername:   nil,
 
+		// The front-end talks to many more wordpress API routes than are
+		// secured below, so let every other route fall through to the backend
+		UnmatchedRoutes: wf.UnmatchedRoutesPolicy{Policy: wf.UnmatchedAllow},
+
 		SupplyOptions: true,
 		Verbose:       true,
 	}
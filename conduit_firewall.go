@@ -3,9 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"strings"
-
-	"github.com/dgrijalva/jwt-go"
+	"os"
+	"time"
 
 	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/tool"
 	wf "github.com/JSmith-BitFlipper/webauthn-firewall-proxy/webauthn_firewall"
@@ -17,6 +16,11 @@ const (
 	frontendPort     int = 4100
 	backendPort      int = 8080
 	reverseProxyPort int = 8081
+
+	// The file holding the secret which the Conduit backend signs its JWTs with. Provision it
+	// with the secret of the backend, i.e. `printf %s "$JWT_SECRET" > conduit_resources/jwt_secret`,
+	// then run with `CONDUIT_JWT_SECRET_FILE=conduit_resources/jwt_secret go run conduit_firewall.go`
+	ENV_JWT_SECRET_FILE string = "CONDUIT_JWT_SECRET_FILE"
 )
 
 var (
@@ -31,27 +35,6 @@ type ConduitFirewall struct {
 	*wf.WebauthnFirewall
 }
 
-func userIDFromJWT(r *http.Request) (int64, error) {
-	// The `tokenString` is the second part after the space in the `authorizationString`
-	authorizationString := r.Header.Get("Authorization")
-	tokenString := strings.Split(authorizationString, " ")[1]
-
-	// Parse the JWT token
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
-	if err != nil {
-		return 0, err
-	}
-
-	// Extract the `userID` from the JWT token
-	userID, ok := token.Claims.(jwt.MapClaims)["id"].(float64)
-	if !ok {
-		return 0, fmt.Errorf("Unable to decode userID from JWT token")
-	}
-
-	// Success!
-	return int64(userID), nil
-}
-
 func commentFromCommentID(args ...interface{}) (interface{}, error) {
 	// Sanity check the input
 	if len(args) != 2 {
@@ -190,6 +173,22 @@ func (firewall *ConduitFirewall) updateUser(w http.ResponseWriter, r *wf.Extende
 }
 
 func main() {
+	secretFile := os.Getenv(ENV_JWT_SECRET_FILE)
+	if secretFile == "" {
+		log.Fatal("Set %s to the file holding the JWT secret of the Conduit backend", ENV_JWT_SECRET_FILE)
+	}
+
+	// Verify the JWTs issued by the backend, which are passed as "Token <jwt>"
+	jwtVerifier, err := wf.NewJWTVerifier(wf.JWTVerifierConfig{
+		Algorithms:     []string{"HS256"},
+		HMACSecretFile: secretFile,
+		UserIDClaim:    "id",
+		CacheTTL:       time.Minute,
+	})
+	if err != nil {
+		log.Fatal("Unable to create JWT verifier from %s=%s: %v", ENV_JWT_SECRET_FILE, secretFile, err)
+	}
+
 	firewallConfigs := &wf.WebauthnFirewallConfig{
 		RPDisplayName: "Foobar Corp.",
 		RPID:          "localhost",
@@ -198,7 +197,7 @@ func main() {
 		ReverseProxyTargetMap: reverseProxyTargetMap,
 		ReverseProxyAddress:   reverseProxyAddress,
 
-		GetUserID: userIDFromJWT,
+		IdentityProvider: jwtVerifier,
 		ContextGetters: wf.ContextGettersType{
 			"comment":      commentFromCommentID,
 			"article":      articleFromArticleSlug,
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+
+	log "unknwon.dev/clog/v2"
+
+	wf "github.com/JSmith-BitFlipper/webauthn-firewall-proxy/webauthn_firewall"
+)
+
+// Usage: go run config_firewall.go [-config firewall.yaml]
+//
+// A generic webauthn firewall whose proxy targets, identity extraction, context
+// getters and secured routes are all described by a YAML or JSON configuration file.
+// The routes are reloaded from the file on SIGHUP, or a POST to /reload of the admin address
+
+func main() {
+	configFile := flag.String("config", "firewall.yaml", "Path to the YAML or JSON firewall configuration")
+	flag.Parse()
+
+	config, err := wf.LoadConfigFile(*configFile)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	firewall, err := config.NewWebauthnFirewall()
+	if err != nil {
+		log.Fatal("Unable to create webauthn firewall: %v", err)
+	}
+
+	firewall.ListenAndServeTLS(config.TLS.Cert, config.TLS.Key)
+}
+
+func init() {
+	// Initialize the logger code
+	err := log.NewConsole()
+	if err != nil {
+		panic("Unable to create new logger: " + err.Error())
+	}
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	log "unknwon.dev/clog/v2"
+)
+
+// A webauthn challenge which was handed out, but not yet used in a ceremony
+type WebauthnChallenge struct {
+	Challenge   string `gorm:"primaryKey;type:varchar(128)"`
+	ExpiresUnix int64  `gorm:"index;not null"`
+}
+
+// Tracks the challenges of the webauthn ceremonies, so that every challenge is used exactly once.
+// A store shared by every firewall replica rules out replays even behind a load balancer
+type ChallengeStore interface {
+	// Record the `challenge` as issued until `expires`
+	IssueChallenge(challenge string, expires time.Time) error
+	// Invalidate the `challenge`, failing if it was never issued, has expired or was already used
+	ConsumeChallenge(challenge string) error
+}
+
+var errChallengeInvalid = fmt.Errorf("Unknown, expired or already used webauthn challenge")
+
+//
+// In memory `ChallengeStore`
+//
+
+// Only rules out replays to this very process, since nothing is shared between replicas
+type memoryChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]int64
+}
+
+var _ ChallengeStore = (*memoryChallengeStore)(nil)
+
+// Create a `ChallengeStore` which is local to this process, for firewalls running as a single replica
+func NewMemoryChallengeStore() ChallengeStore {
+	return newMemoryChallengeStore()
+}
+
+func newMemoryChallengeStore() *memoryChallengeStore {
+	return &memoryChallengeStore{challenges: make(map[string]int64)}
+}
+
+func (m *memoryChallengeStore) IssueChallenge(challenge string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Drop the challenges which expired without ever being used
+	now := time.Now().Unix()
+	for issued, expiresUnix := range m.challenges {
+		if expiresUnix < now {
+			delete(m.challenges, issued)
+		}
+	}
+
+	m.challenges[challenge] = expires.Unix()
+	return nil
+}
+
+func (m *memoryChallengeStore) ConsumeChallenge(challenge string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresUnix, ok := m.challenges[challenge]
+	if !ok {
+		return errChallengeInvalid
+	}
+
+	delete(m.challenges, challenge)
+	if expiresUnix < time.Now().Unix() {
+		return errChallengeInvalid
+	}
+
+	return nil
+}
+
+//
+// Database `ChallengeStore`
+//
+
+func (db *gormStore) IssueChallenge(challenge string, expires time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Drop the challenges which expired without ever being used
+		err := tx.Where("expires_unix < ?", db.NowFunc().Unix()).Delete(new(WebauthnChallenge)).Error
+		if err != nil {
+			log.Error("Failed to delete expired webauthn challenges: %v", err)
+			return err
+		}
+
+		err = tx.Create(&WebauthnChallenge{Challenge: challenge, ExpiresUnix: expires.Unix()}).Error
+		if err != nil {
+			log.Error("Failed to record webauthn challenge: %v", err)
+		}
+		return err
+	})
+}
+
+func (db *gormStore) ConsumeChallenge(challenge string) error {
+	// Deleting the row is atomic, so that only one of any concurrent uses of the `challenge` succeeds
+	result := db.Where("challenge = ? AND expires_unix >= ?", challenge, db.NowFunc().Unix()).
+		Delete(new(WebauthnChallenge))
+	if result.Error != nil {
+		log.Error("Failed to consume webauthn challenge: %v", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errChallengeInvalid
+	}
+
+	return nil
+}
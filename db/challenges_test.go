@@ -0,0 +1,118 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run `test` against the challenge store of every driver
+func forEachChallengeStore(t *testing.T, test func(t *testing.T, store ChallengeStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryChallengeStore())
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "challenges")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Wait on the lock, rather than fail, when consuming concurrently
+		storage, err := NewStorage(Config{
+			Driver: DriverSQLite,
+			DSN:    filepath.Join(dir, "webauthn.db") + "?_busy_timeout=5000",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test(t, storage)
+	})
+}
+
+func TestChallengeStore_SingleUse(t *testing.T) {
+	forEachChallengeStore(t, func(t *testing.T, store ChallengeStore) {
+		if err := store.IssueChallenge("challenge", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.ConsumeChallenge("challenge"); err != nil {
+			t.Fatalf("Unexpected error on first use: %v", err)
+		}
+
+		if err := store.ConsumeChallenge("challenge"); err != errChallengeInvalid {
+			t.Fatalf("Expected the second use to fail, got: %v", err)
+		}
+	})
+}
+
+func TestChallengeStore_Unknown(t *testing.T) {
+	forEachChallengeStore(t, func(t *testing.T, store ChallengeStore) {
+		if err := store.ConsumeChallenge("never issued"); err != errChallengeInvalid {
+			t.Fatalf("Expected an unknown challenge to fail, got: %v", err)
+		}
+	})
+}
+
+func TestChallengeStore_Expiry(t *testing.T) {
+	forEachChallengeStore(t, func(t *testing.T, store ChallengeStore) {
+		if err := store.IssueChallenge("expired", time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.IssueChallenge("valid", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.ConsumeChallenge("expired"); err != errChallengeInvalid {
+			t.Fatalf("Expected the expired challenge to fail, got: %v", err)
+		}
+
+		// Sweeping the expired challenges keeps the valid ones
+		if err := store.ConsumeChallenge("valid"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestChallengeStore_ConcurrentConsume(t *testing.T) {
+	forEachChallengeStore(t, func(t *testing.T, store ChallengeStore) {
+		if err := store.IssueChallenge("challenge", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		const attempts = 16
+
+		var wg sync.WaitGroup
+		errs := make(chan error, attempts)
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- store.ConsumeChallenge("challenge")
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		// Exactly one of the concurrent uses may succeed
+		successes := 0
+		for err := range errs {
+			switch err {
+			case nil:
+				successes++
+			case errChallengeInvalid:
+			default:
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}
+
+		if successes != 1 {
+			t.Fatalf("Expected exactly one use to succeed, got %d", successes)
+		}
+	})
+}
@@ -5,28 +5,54 @@ import (
 	"fmt"
 	"time"
 
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	log "unknwon.dev/clog/v2"
 )
 
-func Init() error {
-	d := newDB()
-	if d == nil {
-		return fmt.Errorf("Unable to create database object")
+// The supported storage drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+	DriverMemory   = "memory"
+)
+
+const defaultSQLiteDSN = "webauthn-firewall.db"
+
+type Config struct {
+	// One of the `Driver*` constants. Defaults to `DriverSQLite`
+	Driver string
+
+	// The data source name handed to the driver, i.e. a file path for SQLite
+	// or a connection string for Postgres and MySQL. Unused by `DriverMemory`
+	DSN string
+
+	// The RP ID of the firewall. Backfills credentials registered before it was recorded
+	RPID string
+}
+
+// Create the `Storage` for the driver selected by `config`
+func NewStorage(config Config) (Storage, error) {
+	// The memory driver has no database to open or migrate
+	if config.Driver == DriverMemory {
+		return newMemoryStore(), nil
 	}
 
-	// Migrate the databse tables
-	if err := autoMigrate(d); err != nil {
-		return err
+	d := newDB(config)
+	if d == nil {
+		return nil, fmt.Errorf("Unable to create database object")
 	}
 
-	// Initialize the database accessors
-	WebauthnStore = &webauthnStore{DB: d}
+	// Bring the databse tables up to the latest schema version
+	if err := migrateUp(d, config, latestMigrationVersion()); err != nil {
+		return nil, err
+	}
 
-	// Success!
-	return nil
+	return &gormStore{DB: d}, nil
 }
 
 // Create a logger interface for the `log` library
@@ -108,8 +134,31 @@ func (l dbLogger) Trace(_ context.Context, begin time.Time, fc func() (string, i
 	}
 }
 
-func newDB() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open("webauthn-firewall.db"), &gorm.Config{
+func newDialector(config Config) (gorm.Dialector, error) {
+	switch config.Driver {
+	case DriverSQLite, "":
+		dsn := config.DSN
+		if dsn == "" {
+			dsn = defaultSQLiteDSN
+		}
+		return sqlite.Open(dsn), nil
+	case DriverPostgres:
+		return postgres.Open(config.DSN), nil
+	case DriverMySQL:
+		return mysql.Open(config.DSN), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage driver: %s", config.Driver)
+	}
+}
+
+func newDB(config Config) *gorm.DB {
+	dialector, err := newDialector(config)
+	if err != nil {
+		log.Error("Storage err: %v", err)
+		return nil
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
 		Logger: defaultLogger,
 		NowFunc: func() time.Time {
 			return time.Now().Local()
@@ -129,7 +178,3 @@ func newDB() *gorm.DB {
 	sqlDB.SetMaxIdleConns(3)
 	return db
 }
-
-func autoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(&WebauthnEntry{})
-}
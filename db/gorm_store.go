@@ -0,0 +1,156 @@
+package db
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	log "unknwon.dev/clog/v2"
+
+	"webauthn/webauthn"
+)
+
+// The `Storage` driver backed by a GORM database (SQLite, Postgres or MySQL)
+type gormStore struct {
+	*gorm.DB
+}
+
+// Make sure `gormStore` implements the `Storage` interface
+var _ Storage = (*gormStore)(nil)
+
+func (db *gormStore) query(query WebauthnQuery) *gorm.DB {
+	tx := db.Model(new(WebauthnEntry))
+	if query.userID != nil {
+		tx = tx.Where("user_id = ?", *query.userID)
+	}
+	if query.username != nil {
+		tx = tx.Where("username = ?", *query.username)
+	}
+	if query.credID != nil {
+		tx = tx.Where("cred_id = ?", query.credID)
+	}
+	return tx
+}
+
+func (db *gormStore) Create(wuser webauthnUser, credential *webauthn.Credential, metadata CredentialMetadata) error {
+	err := db.DB.Create(newWebauthnEntry(wuser, credential, metadata)).Error
+	if err != nil {
+		log.Error("Failed to create webauthn entry [username: %s]: %v", wuser.username, err)
+	}
+	return err
+}
+
+func (db *gormStore) Delete(username string) (err error) {
+	err = db.query(QueryByUsername(username)).Delete(new(WebauthnEntry)).Error
+	if err != nil {
+		log.Error("Failed to delete webauthn entry [username: %s]: %v", username, err)
+	}
+	return
+}
+
+func (db *gormStore) DeleteCredentials(query WebauthnQuery) error {
+	result := db.query(query).Delete(new(WebauthnEntry))
+	if result.Error != nil {
+		log.Error("Failed to delete webauthn entries: %v", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("Webauthn credential not found")
+	}
+
+	return nil
+}
+
+func (db *gormStore) RenameCredential(query WebauthnQuery, nickname string) error {
+	result := db.query(query).Update("nickname", nickname)
+	if result.Error != nil {
+		log.Error("Failed to rename webauthn entry: %v", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("Webauthn credential not found")
+	}
+
+	return nil
+}
+
+// Persist the sign count of the `credential` and mark it as just used
+func (db *gormStore) UpdateSignCount(credential *webauthn.Credential) (err error) {
+	err = db.Model(new(WebauthnEntry)).
+		Where("cred_id = ?", credential.ID).
+		Updates(map[string]interface{}{
+			"sign_count":     credential.Authenticator.SignCount,
+			"last_used_unix": db.NowFunc().Unix(),
+		}).Error
+	if err != nil {
+		log.Error("Failed to update webauthn sign count: %v", err)
+	}
+	return
+}
+
+func (db *gormStore) RecordCloneWarning(wuser webauthnUser, credential *webauthn.Credential, rejected bool) error {
+	event := newCloneWarningEvent(wuser, credential, rejected)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Record the `event` for later investigation
+		if err := tx.Create(event).Error; err != nil {
+			log.Error("Failed to record clone warning: %v", err)
+			return err
+		}
+
+		// Flag the credential itself
+		err := tx.Model(new(WebauthnEntry)).
+			Where("cred_id = ?", credential.ID).
+			Update("clone_warning", true).Error
+		if err != nil {
+			log.Error("Failed to flag webauthn entry with clone warning: %v", err)
+		}
+		return err
+	})
+}
+
+func (db *gormStore) numCredentials(query WebauthnQuery) int64 {
+	var count int64
+	err := db.query(query).Count(&count).Error
+	if err != nil {
+		log.Error("Failed to count webauthn entries: %v", err)
+		return 0
+	}
+	return count
+}
+
+func (db *gormStore) GetCredentials(query WebauthnQuery) ([]WebauthnEntry, error) {
+	ncreds := db.numCredentials(query)
+	if ncreds == 0 {
+		return nil, nil
+	}
+
+	entries := make([]WebauthnEntry, 0, ncreds)
+
+	err := db.query(query).Find(&entries).Error
+	if err != nil {
+		log.Error("Failed to get webauthn entries: %v", err)
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (db *gormStore) IsCredentialRegistered(credID []byte) bool {
+	return db.numCredentials(WebauthnQuery{credID: credID}) > 0
+}
+
+func (db *gormStore) IsUserEnabled(query WebauthnQuery) bool {
+	return db.numCredentials(query) > 0
+}
+
+func (db *gormStore) GetWebauthnUser(query WebauthnQuery) (webauthnUser, error) {
+	// Get the webauthn entries corresponding to the input `WebauthnQuery`
+	entries, err := db.GetCredentials(query)
+	if err != nil {
+		return webauthnUser{}, err
+	}
+
+	return webauthnUserFromEntries(entries), nil
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"webauthn/webauthn"
+)
+
+// The `Storage` driver which keeps everything in memory. Nothing is persisted
+// across restarts, so this is only meant for tests and local development
+type memoryStore struct {
+	mu sync.Mutex
+
+	entries     []*WebauthnEntry
+	cloneEvents []*CloneWarningEvent
+	nextID      uint
+
+	*memoryChallengeStore
+	*memorySessionStorage
+}
+
+// Make sure `memoryStore` implements the `Storage` interface
+var _ Storage = (*memoryStore)(nil)
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		nextID:               1,
+		memoryChallengeStore: newMemoryChallengeStore(),
+		memorySessionStorage: newMemorySessionStorage(),
+	}
+}
+
+// Remove every entry matched by `query`, returning how many there were.
+// NOTE: The caller must hold `m.mu`
+func (m *memoryStore) deleteMatching(query WebauthnQuery) int {
+	kept := m.entries[:0]
+	for _, entry := range m.entries {
+		if !query.matches(entry) {
+			kept = append(kept, entry)
+		}
+	}
+
+	ndeleted := len(m.entries) - len(kept)
+	m.entries = kept
+	return ndeleted
+}
+
+func (m *memoryStore) Create(wuser webauthnUser, credential *webauthn.Credential, metadata CredentialMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Mirror the unique index on `CredID` of the database drivers
+	for _, entry := range m.entries {
+		if bytes.Equal(entry.CredID, credential.ID) {
+			return fmt.Errorf("Webauthn credential already exists")
+		}
+	}
+
+	now := time.Now()
+	entry := newWebauthnEntry(wuser, credential, metadata)
+	entry.ID = m.nextID
+	entry.CreatedAt = now
+	entry.UpdatedAt = now
+	entry.CreatedUnix = now.Unix()
+	m.nextID++
+
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *memoryStore) Delete(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteMatching(QueryByUsername(username))
+	return nil
+}
+
+func (m *memoryStore) DeleteCredentials(query WebauthnQuery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.deleteMatching(query) == 0 {
+		return fmt.Errorf("Webauthn credential not found")
+	}
+	return nil
+}
+
+func (m *memoryStore) RenameCredential(query WebauthnQuery, nickname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := false
+	for _, entry := range m.entries {
+		if query.matches(entry) {
+			entry.Nickname = nickname
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("Webauthn credential not found")
+	}
+	return nil
+}
+
+func (m *memoryStore) UpdateSignCount(credential *webauthn.Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range m.entries {
+		if bytes.Equal(entry.CredID, credential.ID) {
+			entry.SignCount = credential.Authenticator.SignCount
+			entry.LastUsedUnix = time.Now().Unix()
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RecordCloneWarning(wuser webauthnUser, credential *webauthn.Credential, rejected bool) error {
+	event := newCloneWarningEvent(wuser, credential, rejected)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event.CreatedUnix = time.Now().Unix()
+	m.cloneEvents = append(m.cloneEvents, event)
+
+	// Flag the credential itself
+	for _, entry := range m.entries {
+		if bytes.Equal(entry.CredID, credential.ID) {
+			entry.CloneWarning = true
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetCredentials(query WebauthnQuery) ([]WebauthnEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []WebauthnEntry
+	for _, entry := range m.entries {
+		if !query.matches(entry) {
+			continue
+		}
+
+		// Hand out a copy with the derived time fields set, like `AfterFind` does
+		found := *entry
+		found.Created = time.Unix(found.CreatedUnix, 0).Local()
+		if found.LastUsedUnix != 0 {
+			found.LastUsed = time.Unix(found.LastUsedUnix, 0).Local()
+		}
+		entries = append(entries, found)
+	}
+
+	return entries, nil
+}
+
+func (m *memoryStore) IsCredentialRegistered(credID []byte) bool {
+	entries, _ := m.GetCredentials(WebauthnQuery{credID: credID})
+	return len(entries) > 0
+}
+
+func (m *memoryStore) IsUserEnabled(query WebauthnQuery) bool {
+	entries, _ := m.GetCredentials(query)
+	return len(entries) > 0
+}
+
+func (m *memoryStore) GetWebauthnUser(query WebauthnQuery) (webauthnUser, error) {
+	entries, err := m.GetCredentials(query)
+	if err != nil {
+		return webauthnUser{}, err
+	}
+
+	return webauthnUserFromEntries(entries), nil
+}
@@ -0,0 +1,471 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	log "unknwon.dev/clog/v2"
+)
+
+// A single versioned change to the database schema. Migrations must only refer to
+// snapshots of the tables as they were at that version, never to the live models
+type migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB, config Config) error
+	Down    func(tx *gorm.DB, config Config) error
+}
+
+// A row of the migrations table recording an applied `migration`
+type SchemaMigration struct {
+	Version     int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name        string
+	AppliedUnix int64
+}
+
+// The state of every known `migration` as reported by `MigrationStatus`
+type MigrationState struct {
+	Version int64
+	Name    string
+	Applied bool
+}
+
+//
+// Table snapshots used by the migrations
+//
+
+type webauthnEntryV1 struct {
+	gorm.Model
+	UserID      int64  `gorm:"not null"`
+	Username    string `gorm:"not null"`
+	CreatedUnix int64
+	PubKey      []byte
+	CredID      []byte `gorm:"size:1023"`
+	SignCount   uint32 `gorm:"default:0"`
+	RPID        string `gorm:"column:rp_id;type:varchar(253)"`
+}
+
+func (webauthnEntryV1) TableName() string { return "webauthn_entries" }
+
+type webauthnEntryV2 struct {
+	gorm.Model
+	UserID       int64  `gorm:"index;not null"`
+	Username     string `gorm:"index;not null"`
+	Nickname     string `gorm:"type:varchar(64)"`
+	CreatedUnix  int64
+	LastUsedUnix int64
+	PubKey       []byte
+	CredID       []byte `gorm:"uniqueIndex;size:1023"`
+	SignCount    uint32 `gorm:"default:0"`
+	AAGUID       []byte `gorm:"column:aaguid;size:16"`
+	RPID         string `gorm:"column:rp_id;type:varchar(253)"`
+	CloneWarning bool   `gorm:"default:false"`
+}
+
+func (webauthnEntryV2) TableName() string { return "webauthn_entries" }
+
+// The unique indexes of the baseline schema, which allowed a single credential per user. They
+// were named "uix_" by the previous ORM, or "idx_" when the table was created by the current one
+var legacyUniqueIndexes = []struct {
+	Names  []string
+	Column string
+}{
+	{Names: []string{"uix_webauthn_entries_user_id", "idx_webauthn_entries_user_id"}, Column: "user_id"},
+	{Names: []string{"uix_webauthn_entries_username", "idx_webauthn_entries_username"}, Column: "username"},
+}
+
+type webauthnEntryV3 struct {
+	AttestationType string `gorm:"type:varchar(32)"`
+	Transports      string `gorm:"type:varchar(128)"`
+	BackupEligible  bool   `gorm:"default:false"`
+}
+
+func (webauthnEntryV3) TableName() string { return "webauthn_entries" }
+
+type cloneWarningEventV1 struct {
+	gorm.Model
+	UserID            int64  `gorm:"index;not null"`
+	Username          string `gorm:"not null"`
+	CredID            []byte `gorm:"index;size:1023"`
+	StoredSignCount   uint32
+	ReceivedSignCount uint32
+	Rejected          bool
+	CreatedUnix       int64
+}
+
+func (cloneWarningEventV1) TableName() string { return "clone_warning_events" }
+
+type webauthnEntryV4 struct {
+	gorm.Model
+	UserID          string `gorm:"index;not null;type:varchar(255)"`
+	Username        string `gorm:"index;not null"`
+	Nickname        string `gorm:"type:varchar(64)"`
+	CreatedUnix     int64
+	LastUsedUnix    int64
+	PubKey          []byte
+	CredID          []byte `gorm:"uniqueIndex;size:1023"`
+	SignCount       uint32 `gorm:"default:0"`
+	AAGUID          []byte `gorm:"column:aaguid;size:16"`
+	RPID            string `gorm:"column:rp_id;type:varchar(253)"`
+	AttestationType string `gorm:"type:varchar(32)"`
+	Transports      string `gorm:"type:varchar(128)"`
+	BackupEligible  bool   `gorm:"default:false"`
+	CloneWarning    bool   `gorm:"default:false"`
+}
+
+func (webauthnEntryV4) TableName() string { return "webauthn_entries" }
+
+type cloneWarningEventV2 struct {
+	gorm.Model
+	UserID            string `gorm:"index;not null;type:varchar(255)"`
+	Username          string `gorm:"not null"`
+	CredID            []byte `gorm:"index;size:1023"`
+	StoredSignCount   uint32
+	ReceivedSignCount uint32
+	Rejected          bool
+	CreatedUnix       int64
+}
+
+func (cloneWarningEventV2) TableName() string { return "clone_warning_events" }
+
+type webauthnChallengeV1 struct {
+	Challenge   string `gorm:"primaryKey;type:varchar(128)"`
+	ExpiresUnix int64  `gorm:"index;not null"`
+}
+
+func (webauthnChallengeV1) TableName() string { return "webauthn_challenges" }
+
+type webauthnSessionV1 struct {
+	SessionKey  string `gorm:"primaryKey;type:varchar(128)"`
+	Data        []byte
+	ExpiresUnix int64 `gorm:"index;not null"`
+}
+
+func (webauthnSessionV1) TableName() string { return "webauthn_sessions" }
+
+// Every migration in the order they are applied. Append only, never edit an existing entry
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create webauthn entries",
+		Up: func(tx *gorm.DB, _ Config) error {
+			// Databases created before versioned migrations already
+			// have this table, in which case this is a no-op
+			return tx.AutoMigrate(&webauthnEntryV1{})
+		},
+		Down: func(tx *gorm.DB, _ Config) error {
+			return tx.Migrator().DropTable(&webauthnEntryV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "multiple credentials per user and clone warnings",
+		Up: func(tx *gorm.DB, _ Config) error {
+			// `AutoMigrate` never drops an index, so the unique ones would remain. The
+			// plain indexes of the same name are recreated by the `AutoMigrate` below
+			m := tx.Migrator()
+			for _, legacy := range legacyUniqueIndexes {
+				for _, name := range legacy.Names {
+					if m.HasIndex(&webauthnEntryV2{}, name) {
+						if err := m.DropIndex(&webauthnEntryV2{}, name); err != nil {
+							return err
+						}
+					}
+				}
+			}
+
+			return tx.AutoMigrate(&webauthnEntryV2{}, &cloneWarningEventV1{})
+		},
+		Down: func(tx *gorm.DB, _ Config) error {
+			m := tx.Migrator()
+			if err := m.DropTable(&cloneWarningEventV1{}); err != nil {
+				return err
+			}
+
+			for _, index := range []string{"CredID", "Username", "UserID"} {
+				if m.HasIndex(&webauthnEntryV2{}, index) {
+					if err := m.DropIndex(&webauthnEntryV2{}, index); err != nil {
+						return err
+					}
+				}
+			}
+
+			for _, column := range []string{"CloneWarning", "AAGUID", "LastUsedUnix", "Nickname"} {
+				if err := m.DropColumn(&webauthnEntryV2{}, column); err != nil {
+					return err
+				}
+			}
+
+			// Restore the unique indexes in reverse order, which fails if a user has several credentials
+			for idx := len(legacyUniqueIndexes) - 1; idx >= 0; idx-- {
+				legacy := legacyUniqueIndexes[idx]
+				err := tx.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON webauthn_entries (%s)",
+					legacy.Names[0], legacy.Column)).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "authenticator details and the real RP ID",
+		Up: func(tx *gorm.DB, config Config) error {
+			m := tx.Migrator()
+			for _, column := range []string{"AttestationType", "Transports", "BackupEligible"} {
+				if m.HasColumn(&webauthnEntryV3{}, column) {
+					continue
+				}
+				if err := m.AddColumn(&webauthnEntryV3{}, column); err != nil {
+					return err
+				}
+			}
+
+			// Credentials used to be stored with a placeholder RP ID
+			if config.RPID == "" {
+				log.Warn("No RP ID configured, skipping the backfill of the placeholder RP IDs")
+				return nil
+			}
+
+			return tx.Table("webauthn_entries").
+				Where("rp_id = ?", "TODO").
+				Update("rp_id", config.RPID).Error
+		},
+		Down: func(tx *gorm.DB, _ Config) error {
+			m := tx.Migrator()
+			for _, column := range []string{"BackupEligible", "Transports", "AttestationType"} {
+				if err := m.DropColumn(&webauthnEntryV3{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 4,
+		Name:    "opaque string user IDs",
+		Up: func(tx *gorm.DB, _ Config) error {
+			// The numeric user IDs are kept as their decimal form, which is
+			// also how the firewall represents numeric IDs from now on
+			m := tx.Migrator()
+			if err := m.AlterColumn(&webauthnEntryV4{}, "UserID"); err != nil {
+				return err
+			}
+			if err := m.AlterColumn(&cloneWarningEventV2{}, "UserID"); err != nil {
+				return err
+			}
+
+			// SQLite rebuilds the tables to alter a column, so recreate any lost indexes
+			return tx.AutoMigrate(&webauthnEntryV4{}, &cloneWarningEventV2{})
+		},
+		Down: func(tx *gorm.DB, _ Config) error {
+			// Only numeric user IDs fit into the previous schema
+			for _, table := range []string{"webauthn_entries", "clone_warning_events"} {
+				var userIDs []string
+				if err := tx.Table(table).Distinct("user_id").Pluck("user_id", &userIDs).Error; err != nil {
+					return err
+				}
+
+				for _, userID := range userIDs {
+					if _, err := strconv.ParseInt(userID, 10, 64); err != nil {
+						return fmt.Errorf("Table %s holds the non-numeric user ID: %s", table, userID)
+					}
+				}
+			}
+
+			m := tx.Migrator()
+			if err := m.AlterColumn(&webauthnEntryV2{}, "UserID"); err != nil {
+				return err
+			}
+			if err := m.AlterColumn(&cloneWarningEventV1{}, "UserID"); err != nil {
+				return err
+			}
+
+			return tx.AutoMigrate(&webauthnEntryV2{}, &cloneWarningEventV1{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "single use webauthn challenges",
+		Up: func(tx *gorm.DB, _ Config) error {
+			return tx.AutoMigrate(&webauthnChallengeV1{})
+		},
+		Down: func(tx *gorm.DB, _ Config) error {
+			return tx.Migrator().DropTable(&webauthnChallengeV1{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "server-side webauthn sessions",
+		Up: func(tx *gorm.DB, _ Config) error {
+			return tx.AutoMigrate(&webauthnSessionV1{})
+		},
+		Down: func(tx *gorm.DB, _ Config) error {
+			return tx.Migrator().DropTable(&webauthnSessionV1{})
+		},
+	},
+}
+
+func latestMigrationVersion() int64 {
+	return migrations[len(migrations)-1].Version
+}
+
+// Return the versions of every applied migration
+func appliedMigrations(db *gorm.DB) (map[int64]bool, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]bool, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = true
+	}
+
+	return applied, nil
+}
+
+// Apply every pending migration up to and including version `target`
+func migrateUp(db *gorm.DB, config Config, target int64) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	// Refuse to touch a database which was migrated by a newer firewall
+	for version := range applied {
+		if version > latestMigrationVersion() {
+			return fmt.Errorf("Database schema version %d is newer than the latest known version %d",
+				version, latestMigrationVersion())
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version > target || applied[m.Version] {
+			continue
+		}
+
+		log.Info("Applying database migration %d: %s", m.Version, m.Name)
+
+		// Apply the migration and record it atomically
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx, config); err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaMigration{
+				Version:     m.Version,
+				Name:        m.Name,
+				AppliedUnix: time.Now().Unix(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("Database migration %d failed: %v", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// Revert every applied migration newer than version `target`
+func migrateDown(db *gorm.DB, config Config, target int64) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	// Revert the newest migrations first
+	reverse := make([]migration, len(migrations))
+	copy(reverse, migrations)
+	sort.Slice(reverse, func(i, j int) bool { return reverse[i].Version > reverse[j].Version })
+
+	for _, m := range reverse {
+		if m.Version <= target || !applied[m.Version] {
+			continue
+		}
+
+		log.Info("Reverting database migration %d: %s", m.Version, m.Name)
+
+		// Revert the migration and remove its record atomically
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx, config); err != nil {
+				return err
+			}
+
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("Reverting database migration %d failed: %v", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+func openForMigration(config Config) (*gorm.DB, error) {
+	if config.Driver == DriverMemory {
+		return nil, fmt.Errorf("The memory storage driver has no migrations")
+	}
+
+	d := newDB(config)
+	if d == nil {
+		return nil, fmt.Errorf("Unable to create database object")
+	}
+
+	return d, nil
+}
+
+// Apply the pending migrations up to version `target`, or all of them if `target` is 0
+func MigrateUp(config Config, target int64) error {
+	d, err := openForMigration(config)
+	if err != nil {
+		return err
+	}
+
+	if target == 0 {
+		target = latestMigrationVersion()
+	}
+
+	return migrateUp(d, config, target)
+}
+
+// Revert the applied migrations newer than version `target`
+func MigrateDown(config Config, target int64) error {
+	d, err := openForMigration(config)
+	if err != nil {
+		return err
+	}
+
+	return migrateDown(d, config, target)
+}
+
+func MigrationStatus(config Config) ([]MigrationState, error) {
+	d, err := openForMigration(config)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(d)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for idx, m := range migrations {
+		states[idx] = MigrationState{
+			Version: m.Version,
+			Name:    m.Name,
+			Applied: applied[m.Version],
+		}
+	}
+
+	return states, nil
+}
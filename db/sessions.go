@@ -0,0 +1,154 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm/clause"
+	log "unknwon.dev/clog/v2"
+)
+
+// The marshaled session data of a webauthn ceremony, kept between its begin and finish requests
+type WebauthnSession struct {
+	SessionKey  string `gorm:"primaryKey;type:varchar(128)"`
+	Data        []byte
+	ExpiresUnix int64 `gorm:"index;not null"`
+}
+
+// Keeps the session data of the webauthn ceremonies on the server, rather than in the client cookies
+type SessionStorage interface {
+	// Store the `data` under `key`, replacing any previous data, until `expires`
+	SaveSession(key string, data []byte, expires time.Time) error
+	// Load the data stored under `key`, failing if there is none or it has expired
+	LoadSession(key string) ([]byte, error)
+}
+
+var errSessionNotFound = fmt.Errorf("Webauthn session not found or expired")
+
+const (
+	// How often the in memory storage drops its expired sessions
+	sessionSweepInterval = time.Minute
+
+	// How many expired sessions the database storage drops on every save. Every save adds at most
+	// one session, so the expired sessions are dropped as fast as they pile up
+	sessionSweepBatch = 100
+)
+
+//
+// In memory `SessionStorage`
+//
+
+type memorySession struct {
+	data        []byte
+	expiresUnix int64
+}
+
+// Only shares the sessions within this very process, since nothing is shared between replicas
+type memorySessionStorage struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+var _ SessionStorage = (*memorySessionStorage)(nil)
+
+// Create a `SessionStorage` which is local to this process, for firewalls running as a single replica
+func NewMemorySessionStorage() SessionStorage {
+	return newMemorySessionStorage()
+}
+
+func newMemorySessionStorage() *memorySessionStorage {
+	return &memorySessionStorage{sessions: make(map[string]memorySession)}
+}
+
+func (m *memorySessionStorage) SaveSession(key string, data []byte, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Drop the sessions which expired without their ceremony being finished, but
+	// only every so often rather than walking through every session on every save
+	if now := time.Now(); now.Sub(m.lastSweep) >= sessionSweepInterval {
+		for stored, session := range m.sessions {
+			if session.expiresUnix < now.Unix() {
+				delete(m.sessions, stored)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	m.sessions[key] = memorySession{data: data, expiresUnix: expires.Unix()}
+	return nil
+}
+
+func (m *memorySessionStorage) LoadSession(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[key]
+	if !ok || session.expiresUnix < time.Now().Unix() {
+		return nil, errSessionNotFound
+	}
+
+	return session.data, nil
+}
+
+//
+// Database `SessionStorage`
+//
+
+func (db *gormStore) SaveSession(key string, data []byte, expires time.Time) error {
+	db.sweepExpiredSessions()
+
+	// Replace the data of a ceremony which is begun again
+	err := db.Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&WebauthnSession{SessionKey: key, Data: data, ExpiresUnix: expires.Unix()}).Error
+	if err != nil {
+		log.Error("Failed to save webauthn session: %v", err)
+	}
+	return err
+}
+
+// Drop a batch of the sessions which expired without their ceremony being finished. Left over
+// sessions are never loaded, so a failure is only logged rather than failing the save
+func (db *gormStore) sweepExpiredSessions() {
+	now := db.NowFunc().Unix()
+
+	var expiredKeys []string
+	err := db.Model(new(WebauthnSession)).
+		Where("expires_unix < ?", now).
+		Limit(sessionSweepBatch).
+		Pluck("session_key", &expiredKeys).Error
+	if err != nil {
+		log.Warn("Failed to look up expired webauthn sessions: %v", err)
+		return
+	}
+
+	if len(expiredKeys) == 0 {
+		return
+	}
+
+	// Check the expiry again, in case a session was saved anew in the meantime
+	err = db.Where("session_key IN ? AND expires_unix < ?", expiredKeys, now).
+		Delete(new(WebauthnSession)).Error
+	if err != nil {
+		log.Warn("Failed to delete expired webauthn sessions: %v", err)
+	}
+}
+
+func (db *gormStore) LoadSession(key string) ([]byte, error) {
+	var sessions []WebauthnSession
+	err := db.Where("session_key = ? AND expires_unix >= ?", key, db.NowFunc().Unix()).
+		Limit(1).
+		Find(&sessions).Error
+	if err != nil {
+		log.Error("Failed to load webauthn session: %v", err)
+		return nil, err
+	}
+
+	if len(sessions) == 0 {
+		return nil, errSessionNotFound
+	}
+
+	return sessions[0].Data, nil
+}
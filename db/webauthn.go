@@ -1,6 +1,8 @@
 package db
 
 import (
+	"bytes"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -12,16 +14,55 @@ import (
 type WebauthnEntry struct {
 	gorm.Model
 	// Metadata entries
-	UserID      int64     `gorm:"unique_index;not null"`
-	Username    string    `gorm:"unique_index;not null"`
-	Created     time.Time `gorm:"-"`
-	CreatedUnix int64
+	UserID       string    `gorm:"index;not null;type:varchar(255)"`
+	Username     string    `gorm:"index;not null"`
+	Nickname     string    `gorm:"type:varchar(64)"`
+	Created      time.Time `gorm:"-"`
+	CreatedUnix  int64
+	LastUsed     time.Time `gorm:"-"`
+	LastUsedUnix int64
+
+	// Webauthn entries. The binary columns only set a size rather than a type, so that
+	// every dialect stores raw bytes: a blob, bytea or varbinary
+	PubKey          []byte
+	CredID          []byte `gorm:"uniqueIndex;size:1023"`
+	SignCount       uint32 `gorm:"default:0"`
+	AAGUID          []byte `gorm:"column:aaguid;size:16"`
+	RPID            string `gorm:"column:rp_id;type:varchar(253)"`
+	AttestationType string `gorm:"type:varchar(32)"`
+	Transports      string `gorm:"type:varchar(128)"` // Comma separated list
+	BackupEligible  bool   `gorm:"default:false"`
+
+	// Set once the authenticator reports a sign counter regression
+	CloneWarning bool `gorm:"default:false"`
+}
+
+// A record of an authenticator reporting a sign counter which did not increase.
+// This is a signal that the credential private key may have been cloned
+type CloneWarningEvent struct {
+	gorm.Model
+	UserID            string `gorm:"index;not null;type:varchar(255)"`
+	Username          string `gorm:"not null"`
+	CredID            []byte `gorm:"index;size:1023"`
+	StoredSignCount   uint32
+	ReceivedSignCount uint32
+	Rejected          bool
+	Created           time.Time `gorm:"-"`
+	CreatedUnix       int64
+}
+
+// NOTE: This is a GORM create hook.
+func (t *CloneWarningEvent) BeforeCreate(tx *gorm.DB) error {
+	if t.CreatedUnix == 0 {
+		t.CreatedUnix = tx.NowFunc().Unix()
+	}
+	return nil
+}
 
-	// Webauthn entries
-	PubKey    []byte `gorm:"unique_index;type:varchar(65)"`
-	CredID    []byte `gorm:"unique_index;type:varchar(250)"`
-	SignCount uint32 `gorm:"default:0"`
-	RPID      string `gorm:"column:rp_id;type:varchar(253)"`
+// NOTE: This is a GORM query hook.
+func (t *CloneWarningEvent) AfterFind(tx *gorm.DB) error {
+	t.Created = time.Unix(t.CreatedUnix, 0).Local()
+	return nil
 }
 
 // NOTE: This is a GORM create hook.
@@ -35,103 +76,153 @@ func (t *WebauthnEntry) BeforeCreate(tx *gorm.DB) error {
 // NOTE: This is a GORM query hook.
 func (t *WebauthnEntry) AfterFind(tx *gorm.DB) error {
 	t.Created = time.Unix(t.CreatedUnix, 0).Local()
+	if t.LastUsedUnix != 0 {
+		t.LastUsed = time.Unix(t.LastUsedUnix, 0).Local()
+	}
 	return nil
 }
 
+func (t *WebauthnEntry) TransportList() []string {
+	if t.Transports == "" {
+		return []string{}
+	}
+	return strings.Split(t.Transports, ",")
+}
+
+// Rebuild the `webauthn.Credential` stored in the entry
+func (t *WebauthnEntry) credential() webauthn.Credential {
+	var credential webauthn.Credential
+	credential.ID = t.CredID
+	credential.PublicKey = t.PubKey
+	credential.AttestationType = t.AttestationType
+	credential.Authenticator = webauthn.Authenticator{
+		AAGUID:    t.AAGUID,
+		SignCount: t.SignCount,
+	}
+	return credential
+}
+
 //
-// `WebauthnEntry` storage methods
+// `WebauthnEntry` storage interface
 //
 
-type webauthnStore struct {
-	*gorm.DB
-}
+// The operations every storage driver of the webauthn credentials implements
+type Storage interface {
+	Create(wuser webauthnUser, credential *webauthn.Credential, metadata CredentialMetadata) error
+	Delete(username string) error
+	DeleteCredentials(query WebauthnQuery) error
+	RenameCredential(query WebauthnQuery, nickname string) error
 
-type WebauthnQuery func(*webauthnStore) *gorm.DB
+	UpdateSignCount(credential *webauthn.Credential) error
+	RecordCloneWarning(wuser webauthnUser, credential *webauthn.Credential, rejected bool) error
 
-var WebauthnStore *webauthnStore
+	GetCredentials(query WebauthnQuery) ([]WebauthnEntry, error)
+	IsCredentialRegistered(credID []byte) bool
+	IsUserEnabled(query WebauthnQuery) bool
+	GetWebauthnUser(query WebauthnQuery) (webauthnUser, error)
 
-func QueryByUserID(userID int64) WebauthnQuery {
-	return func(db *webauthnStore) *gorm.DB {
-		return db.Model(new(WebauthnEntry)).Where("user_id = ?", userID)
-	}
+	// Every driver can also track the challenges and keep the session data of the webauthn ceremonies
+	ChallengeStore
+	SessionStorage
 }
 
-func QueryByUsername(username string) WebauthnQuery {
-	return func(db *webauthnStore) *gorm.DB {
-		return db.Model(new(WebauthnEntry)).Where("username = ?", username)
-	}
+// Selects a set of `WebauthnEntry`s. Unset fields match every entry
+type WebauthnQuery struct {
+	userID   *string
+	username *string
+	credID   []byte
 }
 
-func (db *webauthnStore) Create(wuser webauthnUser, credential *webauthn.Credential) error {
-	wentry := &WebauthnEntry{
-		UserID:    wuser.userID,
-		Username:  wuser.username,
-		PubKey:    credential.PublicKey,
-		CredID:    credential.ID,
-		SignCount: credential.Authenticator.SignCount,
-		RPID:      "TODO",
-	}
+func QueryByUserID(userID string) WebauthnQuery {
+	return WebauthnQuery{userID: &userID}
+}
 
-	return db.DB.Create(&wentry).Error
+func QueryByUsername(username string) WebauthnQuery {
+	return WebauthnQuery{username: &username}
 }
 
-func (db *webauthnStore) Delete(username string) (err error) {
-	err = db.Model(new(WebauthnEntry)).Where("username = ?", username).Delete(new(WebauthnEntry)).Error
-	if err != nil {
-		log.Error("Failed to delete webauthn entry [username: %s]: %v", username, err)
-	}
-	return
+func QueryByCredID(userID string, credID []byte) WebauthnQuery {
+	return WebauthnQuery{userID: &userID, credID: credID}
 }
 
-func (db *webauthnStore) numCredentials(query WebauthnQuery) int64 {
-	var count int64
-	err := query(db).Count(&count).Error
-	if err != nil {
-		log.Error("Failed to count webauthn entries: %v", err)
-		return 0
+func (q WebauthnQuery) matches(entry *WebauthnEntry) bool {
+	if q.userID != nil && *q.userID != entry.UserID {
+		return false
 	}
-	return count
+	if q.username != nil && *q.username != entry.Username {
+		return false
+	}
+	if q.credID != nil && !bytes.Equal(q.credID, entry.CredID) {
+		return false
+	}
+	return true
 }
 
-func (db *webauthnStore) getCredentials(query WebauthnQuery) (*WebauthnEntry, error) {
-	ncreds := db.numCredentials(query)
-	if ncreds == 0 {
-		return nil, nil
-	}
+// Registration details which are not part of the `webauthn.Credential`
+type CredentialMetadata struct {
+	RPID           string
+	Nickname       string
+	Transports     []string
+	BackupEligible bool
+}
 
-	entry := new(WebauthnEntry)
+func newWebauthnEntry(wuser webauthnUser, credential *webauthn.Credential, metadata CredentialMetadata) *WebauthnEntry {
+	return &WebauthnEntry{
+		UserID:          wuser.userID,
+		Username:        wuser.username,
+		Nickname:        metadata.Nickname,
+		PubKey:          credential.PublicKey,
+		CredID:          credential.ID,
+		SignCount:       credential.Authenticator.SignCount,
+		AAGUID:          credential.Authenticator.AAGUID,
+		RPID:            metadata.RPID,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(metadata.Transports, ","),
+		BackupEligible:  metadata.BackupEligible,
+	}
+}
 
-	err := query(db).First(&entry).Error
-	if err != nil {
-		log.Error("Failed to get webauthn entries: %v", err)
-		return nil, err
+func newCloneWarningEvent(wuser webauthnUser, credential *webauthn.Credential, rejected bool) *CloneWarningEvent {
+	// Find the sign count stored before the `credential` was used
+	var storedSignCount uint32
+	for _, cred := range wuser.credentials {
+		if bytes.Equal(cred.ID, credential.ID) {
+			storedSignCount = cred.Authenticator.SignCount
+			break
+		}
 	}
 
-	return entry, nil
-}
+	log.Warn("Possible cloned authenticator [user_id: %s, username: %s, stored: %d, received: %d]",
+		wuser.userID, wuser.username, storedSignCount, credential.Authenticator.SignCount)
 
-func (db *webauthnStore) IsUserEnabled(query WebauthnQuery) bool {
-	return db.numCredentials(query) > 0
+	return &CloneWarningEvent{
+		UserID:            wuser.userID,
+		Username:          wuser.username,
+		CredID:            credential.ID,
+		StoredSignCount:   storedSignCount,
+		ReceivedSignCount: credential.Authenticator.SignCount,
+		Rejected:          rejected,
+	}
 }
 
-func (db *webauthnStore) GetWebauthnUser(query WebauthnQuery) (webauthnUser, error) {
-	// Get the webauthn entry corresponding to the input `WebauthnQuery`
-	entry, err := WebauthnStore.getCredentials(query)
-	if entry == nil || err != nil {
-		return webauthnUser{}, err
+// Build a `webauthnUser` holding the credentials of every one of the `entries`
+func webauthnUserFromEntries(entries []WebauthnEntry) webauthnUser {
+	if len(entries) == 0 {
+		return webauthnUser{}
 	}
 
-	// Create a new `webauthnUser`
-	w := NewWebauthnUser(entry.UserID, entry.Username, nil)
+	// Create a new `webauthnUser`. Every entry of a user shares
+	// the same `UserID` and `Username`, so take them from the first
+	w := NewWebauthnUser(entries[0].UserID, entries[0].Username, nil)
 
-	// Rebuild the `credential` from the `entry`
-	var credential webauthn.Credential
-	credential.ID = entry.CredID
-	credential.PublicKey = entry.PubKey
-	credential.Authenticator = webauthn.Authenticator{SignCount: entry.SignCount}
+	// Rebuild every `credential` from its respective `entry`
+	credentials := make([]webauthn.Credential, len(entries))
+	for idx, entry := range entries {
+		credentials[idx] = entry.credential()
+	}
 
-	// Set the `credential` into the `webauthnUser`
-	w.credentials = []webauthn.Credential{credential}
+	// Set the `credentials` into the `webauthnUser`
+	w.credentials = credentials
 
-	return w, nil
+	return w
 }
@@ -2,13 +2,21 @@ package db
 
 import (
 	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
 
+	"webauthn/protocol"
 	"webauthn/webauthn"
 )
 
+// The most bytes of a user handle allowed by the webauthn spec
+const maxWebAuthnIDLength = 64
+
 // Webauthn is public key of a user.
 type webauthnUser struct {
-	userID      int64
+	// An opaque user ID. Numeric IDs are stored in their decimal form
+	userID      string
 	username    string
 	credentials []webauthn.Credential
 }
@@ -16,7 +24,7 @@ type webauthnUser struct {
 // Make sure `webauthnUser` implements the `webauthn.User` interface
 var _ webauthn.User = webauthnUser{}
 
-func NewWebauthnUser(userID int64, username string, credentials []webauthn.Credential) webauthnUser {
+func NewWebauthnUser(userID string, username string, credentials []webauthn.Credential) webauthnUser {
 	w := webauthnUser{
 		userID:      userID,
 		username:    username,
@@ -25,10 +33,57 @@ func NewWebauthnUser(userID int64, username string, credentials []webauthn.Crede
 	return w
 }
 
+// Numeric user IDs are encoded as a uvarint padded to `binary.MaxVarintLen64` bytes, which is how
+// every user handle was encoded before string IDs were supported. Any other ID is encoded as a
+// zero byte followed by the ID itself. The zero byte never starts the encoding of a numeric ID,
+// except for the ID 0 which is entirely zeros, and `CheckUserID` forbids zero bytes in IDs
 func (w webauthnUser) WebAuthnID() []byte {
-	buf := make([]byte, binary.MaxVarintLen64)
-	binary.PutUvarint(buf, uint64(w.userID))
-	return buf
+	if numericID, ok := parseNumericUserID(w.userID); ok {
+		buf := make([]byte, binary.MaxVarintLen64)
+		binary.PutUvarint(buf, uint64(numericID))
+		return buf
+	}
+
+	return append([]byte{0}, w.userID...)
+}
+
+// Recover the user ID encoded by `WebAuthnID`, such as from the user handle of an assertion
+func UserIDFromWebAuthnID(webauthnID []byte) (string, error) {
+	if len(webauthnID) > 1 && webauthnID[0] == 0 && webauthnID[1] != 0 {
+		return string(webauthnID[1:]), nil
+	}
+
+	userID, n := binary.Uvarint(webauthnID)
+	if n <= 0 {
+		return "", fmt.Errorf("Malformed webauthn user handle")
+	}
+	return strconv.FormatInt(int64(userID), 10), nil
+}
+
+// Check that `userID` can be encoded into a user handle
+func CheckUserID(userID string) error {
+	if userID == "" {
+		return fmt.Errorf("Empty user ID")
+	}
+
+	if strings.IndexByte(userID, 0) != -1 {
+		return fmt.Errorf("User ID may not contain zero bytes")
+	}
+
+	if len(NewWebauthnUser(userID, "", nil).WebAuthnID()) > maxWebAuthnIDLength {
+		return fmt.Errorf("User ID is longer than %d bytes", maxWebAuthnIDLength-1)
+	}
+
+	return nil
+}
+
+// Numeric IDs are only those whose decimal form is canonical, i.e. "42" but not "042"
+func parseNumericUserID(userID string) (int64, bool) {
+	numericID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil || strconv.FormatInt(numericID, 10) != userID {
+		return 0, false
+	}
+	return numericID, true
 }
 
 func (w webauthnUser) WebAuthnName() string {
@@ -46,3 +101,16 @@ func (w webauthnUser) WebAuthnIcon() string {
 func (w webauthnUser) WebAuthnCredentials() []webauthn.Credential {
 	return w.credentials
 }
+
+// Build the list of credentials an authenticator must not register again
+func (w webauthnUser) CredentialExcludeList() []protocol.CredentialDescriptor {
+	excludeList := make([]protocol.CredentialDescriptor, len(w.credentials))
+	for idx, credential := range w.credentials {
+		excludeList[idx] = protocol.CredentialDescriptor{
+			Type:         protocol.PublicKeyCredentialType,
+			CredentialID: credential.ID,
+		}
+	}
+
+	return excludeList
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestWebAuthnID(t *testing.T) {
+	tests := []struct {
+		userID string
+		want   []byte
+	}{
+		// Numeric IDs keep the padded uvarint encoding of the integer user IDs
+		{userID: "0", want: make([]byte, binary.MaxVarintLen64)},
+		{userID: "1", want: []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{userID: "300", want: []byte{0xac, 0x02, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{userID: "9223372036854775807", want: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 0}},
+		{userID: "-1", want: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+
+		// Every other ID is prefixed by a zero byte
+		{userID: "alice", want: []byte("\x00alice")},
+		{userID: "042", want: []byte("\x00042")},
+		{userID: "+42", want: []byte("\x00+42")},
+		{userID: "18446744073709551616", want: []byte("\x0018446744073709551616")},
+		{userID: "auth0|5f7c8ec7c33c6c004bbafe82", want: []byte("\x00auth0|5f7c8ec7c33c6c004bbafe82")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.userID, func(t *testing.T) {
+			webauthnID := NewWebauthnUser(test.userID, "", nil).WebAuthnID()
+			if !bytes.Equal(webauthnID, test.want) {
+				t.Fatalf("WebAuthnID: got %x, want %x", webauthnID, test.want)
+			}
+
+			userID, err := UserIDFromWebAuthnID(webauthnID)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if userID != test.userID {
+				t.Fatalf("Round trip: got %q, want %q", userID, test.userID)
+			}
+		})
+	}
+}
+
+func TestUserIDFromWebAuthnID_Malformed(t *testing.T) {
+	for _, webauthnID := range [][]byte{nil, {0x80}, {0xff, 0xff}} {
+		if userID, err := UserIDFromWebAuthnID(webauthnID); err == nil {
+			t.Errorf("Expected %x to be refused, got %q", webauthnID, userID)
+		}
+	}
+}
+
+func TestCheckUserID(t *testing.T) {
+	tests := []struct {
+		name    string
+		userID  string
+		wantErr string
+	}{
+		{name: "numeric", userID: "42"},
+		{name: "string", userID: "alice"},
+		{name: "longest string", userID: strings.Repeat("a", maxWebAuthnIDLength-1)},
+		{name: "long numeric", userID: "9223372036854775807"},
+		{name: "empty", userID: "", wantErr: "Empty"},
+		{name: "NUL", userID: "ali\x00ce", wantErr: "zero bytes"},
+		{name: "leading NUL", userID: "\x00alice", wantErr: "zero bytes"},
+		{name: "too long", userID: strings.Repeat("a", maxWebAuthnIDLength), wantErr: "longer than"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckUserID(test.userID)
+
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Expected an error containing %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
@@ -14,8 +14,11 @@ require (
 	github.com/pkg/profile v1.5.0 // indirect
 	github.com/satori/go.uuid v1.2.0 // indirect
 	gopkg.in/macaron.v1 v1.4.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
+	gorm.io/driver/mysql v1.0.3
+	gorm.io/driver/postgres v1.0.8
 	gorm.io/driver/sqlite v1.1.4
-	gorm.io/gorm v1.20.11
+	gorm.io/gorm v1.20.12
 	unknwon.dev/clog/v2 v2.2.0
 	webauthn v0.0.0-00010101000000-000000000000
 	webauthn_utils v0.0.0-00010101000000-000000000000
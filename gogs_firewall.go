@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/tool"
 	wf "github.com/JSmith-BitFlipper/webauthn-firewall-proxy/webauthn_firewall"
@@ -15,6 +18,14 @@ const (
 	frontendPort     int = 8081
 	backendPort      int = 3000
 	reverseProxyPort int = 8081
+
+	// The backend signs in any user ID posted to its `/server_context/user2session` hook, so only
+	// the firewall may call it. The firewall denies `/server_context/**` to clients, and sends this
+	// secret with its own calls in the `serverContextSecretHeader`. Set the same secret in the Gogs
+	// backend, which must refuse hook calls without it, then run with
+	// `GOGS_SERVER_CONTEXT_SECRET=<secret> go run gogs_firewall.go`
+	ENV_SERVER_CONTEXT_SECRET string = "GOGS_SERVER_CONTEXT_SECRET"
+	serverContextSecretHeader string = "X-Server-Context-Secret"
 )
 
 var (
@@ -23,42 +34,45 @@ var (
 	reverseProxyAddress string = fmt.Sprintf("localhost:%d", reverseProxyPort)
 
 	reverseProxyTargetMap = wf.NewProxyTarget(reverseProxyAddress, backendAddress, wf.GetFormInput)
+
+	serverContextSecret string
 )
 
 type GogsFirewall struct {
 	*wf.WebauthnFirewall
 }
 
-func userIDFromSession(r *http.Request) (int64, error) {
-	// Get the UserID associated with the sessionID in the cookies. This is to assure that the
-	// server and the firewall are referencing the same user during the webauthn check
-	url := fmt.Sprintf("%s/server_context/session2user", backendAddress)
-	userIDReq, err := http.NewRequest("GET", url, nil)
+func sessionFromUserID(w http.ResponseWriter, r *wf.ExtendedRequest, userID string) error {
+	// Have the server sign in the `userID`, which responds with the session cookies
+	sessionURL := fmt.Sprintf("%s/server_context/user2session/%s", backendAddress, url.PathEscape(userID))
+	sessionReq, err := http.NewRequest("POST", sessionURL, nil)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	sessionReq.Header.Set(serverContextSecretHeader, serverContextSecret)
 
-	// Pass on the cookies from `r` to `userIDReq`, which will include the cookie with the `sessionID`
-	for _, cookie := range r.Cookies() {
-		userIDReq.AddCookie(cookie)
+	resp, err := tool.PerformRequest(sessionReq)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	var sessionInfo struct {
-		Ok     bool  `json:"ok"`
-		UserID int64 `json:"uid"`
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to create a session for user %s", userID)
 	}
 
-	err = tool.PerformRequestJSON(userIDReq, &sessionInfo)
-	if err != nil {
-		return 0, err
+	// Pass on the session cookies to the client
+	for _, cookie := range resp.Cookies() {
+		http.SetCookie(w, cookie)
 	}
 
-	if !sessionInfo.Ok {
-		return 0, fmt.Errorf("Unable to retrieve the userID for this cookie session")
-	}
+	// Redirect to the dashboard now that the user is signed in
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"redirectTo": "/"}`))
 
 	// Success!
-	return sessionInfo.UserID, nil
+	return nil
 }
 
 func itemFromIDs(itemType string, nargs int) func(...interface{}) (interface{}, error) {
@@ -136,7 +150,7 @@ func (firewall *GogsFirewall) publishNewRelease(w http.ResponseWriter, r *wf.Ext
 	title := r.Get("title")
 
 	// Get the names of the `attachments` being uploaded
-	uuids := r.Request.Form["files"]
+	uuids := r.GetMultipartInputArray("files")
 	attachments := make([]wf.StructContext, len(uuids))
 	for idx, uuid := range uuids {
 		// Retrieve the `Attachment` struct for the respective `uuid`
@@ -169,6 +183,23 @@ func (firewall *GogsFirewall) publishNewRelease(w http.ResponseWriter, r *wf.Ext
 }
 
 func main() {
+	serverContextSecret = os.Getenv(ENV_SERVER_CONTEXT_SECRET)
+	if serverContextSecret == "" {
+		log.Fatal("Set %s to the secret which the Gogs backend requires of its session hook", ENV_SERVER_CONTEXT_SECRET)
+	}
+
+	// Resolve the userID of the session cookie from the backend
+	identityProvider, err := wf.NewBackendIdentityProvider(wf.BackendIdentityConfig{
+		URL:            fmt.Sprintf("%s/server_context/session2user", backendAddress),
+		ForwardCookies: true,
+		UserIDPath:     "uid",
+		OkPath:         "ok",
+		CacheTTL:       30 * time.Second,
+	})
+	if err != nil {
+		log.Fatal("Unable to create identity provider: %v", err)
+	}
+
 	firewallConfigs := &wf.WebauthnFirewallConfig{
 		RPDisplayName: "Foobar Corp.",
 		RPID:          "localhost",
@@ -177,7 +208,7 @@ func main() {
 		ReverseProxyTargetMap: reverseProxyTargetMap,
 		ReverseProxyAddress:   reverseProxyAddress,
 
-		GetUserID: userIDFromSession,
+		IdentityProvider: identityProvider,
 		ContextGetters: wf.ContextGettersType{
 			"ssh_key":    itemFromIDs("ssh_key", 1),
 			"repo":       itemFromIDs("repository", 1),
@@ -192,6 +223,10 @@ func main() {
 		LoginGetUsername: func(r *wf.ExtendedRequest) (string, error) {
 			return r.Get_WithErr("user_name")
 		},
+		PasswordlessLogin: sessionFromUserID,
+
+		// The internal endpoints of the backend, which hand out sessions and data of any user
+		DeniedRoutes: []wf.RoutePattern{{Path: "/server_context/**"}},
 
 		SupplyOptions: false,
 		Verbose:       true,
@@ -200,7 +235,7 @@ func main() {
 	// Initialize a new webauthn firewall as a `GogsFirewall` to be able to add custom methods
 	firewall := GogsFirewall{wf.NewWebauthnFirewall(firewallConfigs)}
 
-	firewall.Secure("POST", "/{username}/{reponame}/settings", firewall.repoSettings)
+	firewall.Secure("POST", "/{username}/{reponame}/settings", firewall.repoSettings, wf.RequireUserVerification())
 
 	firewall.Secure("POST", "/user/settings/ssh", firewall.Authn(
 		"Add SSH key named: %v",
@@ -223,7 +258,7 @@ func main() {
 
 	firewall.Secure("POST", "/user/settings/password", firewall.Authn(
 		"Confirm password change",
-	))
+	), wf.RequireUserVerification())
 
 	firewall.Secure("POST", "/user/settings/repositories/leave", firewall.Authn(
 		"Leave repository named: %v",
@@ -237,7 +272,8 @@ func main() {
 		wf.GetVar("app_token").SubField("Name"),
 	))
 
-	firewall.Secure("POST", "/{username}/{repo}/releases/new", firewall.publishNewRelease)
+	// Release attachments are uploaded with the form, so allow for larger bodies
+	firewall.Secure("POST", "/{username}/{repo}/releases/new", firewall.publishNewRelease, wf.MaxBodySize(64<<20))
 
 	firewall.Secure("POST", "/{username}/{repo}/settings/hooks/delete", firewall.Authn(
 		"Delete webhook for: URL %v",
@@ -15,12 +15,12 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	log "unknwon.dev/clog/v2"
 
 	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
 	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/tool"
+	wf "github.com/JSmith-BitFlipper/webauthn-firewall-proxy/webauthn_firewall"
 
 	"webauthn/protocol"
 	"webauthn/webauthn"
@@ -33,6 +33,8 @@ const (
 	reverseProxyPort int = 8081
 
 	ENV_SESSION_KEY string = "SESSION_KEY"
+	// The file holding the secret which the Conduit backend signs its JWTs with
+	ENV_JWT_SECRET_FILE string = "CONDUIT_JWT_SECRET_FILE"
 
 	verbose bool = true
 )
@@ -44,6 +46,7 @@ var (
 
 	webauthnAPI  *webauthn.WebAuthn
 	sessionStore *session.Store
+	jwtVerifier  *wf.JWTVerifier
 )
 
 func logRequest(r *http.Request) {
@@ -62,25 +65,9 @@ func printRequestContents(r *http.Request) error {
 	return nil
 }
 
-func userIDFromJWT(r *http.Request) (int64, error) {
-	// The `tokenString` is the second part after the space in the `authorizationString`
-	authorizationString := r.Header.Get("Authorization")
-	tokenString := strings.Split(authorizationString, " ")[1]
-
-	// Parse the JWT token
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
-	if err != nil {
-		return 0, err
-	}
-
-	// Extract the `userID` from the JWT token
-	userID, ok := token.Claims.(jwt.MapClaims)["id"].(float64)
-	if !ok {
-		return 0, fmt.Errorf("Unable to decode userID from JWT token")
-	}
-
-	// Success!
-	return int64(userID), nil
+func userIDFromJWT(r *http.Request) (string, error) {
+	// Only a JWT signed by the backend identifies the user
+	return jwtVerifier.GetUserID(r)
 }
 
 type Comment struct {
@@ -165,14 +152,14 @@ func getCurrentUser(r *http.Request) (*CurrentUser, error) {
 	return &currentUser.User, nil
 }
 
-func checkWebauthnAssertion(
+func (proxy *WebauthnFirewall) checkWebauthnAssertion(
 	r *http.Request,
 	query db.WebauthnQuery,
 	expectedExtensions protocol.AuthenticationExtensions,
 	assertion string) error {
 
 	// Get a `webauthnUser` from the input `query`
-	wuser, err := db.WebauthnStore.GetWebauthnUser(query)
+	wuser, err := proxy.storage.GetWebauthnUser(query)
 	if err != nil {
 		return err
 	}
@@ -239,9 +226,12 @@ func (rf *RequestRefiller) Refill() {
 
 type WebauthnFirewall struct {
 	*httputil.ReverseProxy
+
+	// Holds the webauthn credentials of the users
+	storage db.Storage
 }
 
-func NewWebauthnFirewall() *WebauthnFirewall {
+func NewWebauthnFirewall(storage db.Storage) *WebauthnFirewall {
 	origin, _ := url.Parse(backendAddress)
 	proxy := httputil.NewSingleHostReverseProxy(origin)
 
@@ -259,6 +249,7 @@ func NewWebauthnFirewall() *WebauthnFirewall {
 	// Construct and return the webauthn firewall
 	return &WebauthnFirewall{
 		proxy,
+		storage,
 	}
 }
 
@@ -317,7 +308,7 @@ func (proxy *WebauthnFirewall) webauthnSecure(
 		}
 
 		// See if the user has webauthn enabled
-		isEnabled := db.WebauthnStore.IsUserEnabled(db.QueryByUserID(userID))
+		isEnabled := proxy.storage.IsUserEnabled(db.QueryByUserID(userID))
 
 		// Perform a webauthn check if webauthn is enabled for this user
 		if isEnabled {
@@ -354,7 +345,7 @@ func (proxy *WebauthnFirewall) webauthnSecure(
 
 			// Check the webauthn assertion for this operation
 			if extensions != nil {
-				err = checkWebauthnAssertion(r, db.QueryByUserID(userID), extensions, reqBody.Assertion)
+				err = proxy.checkWebauthnAssertion(r, db.QueryByUserID(userID), extensions, reqBody.Assertion)
 				if err != nil {
 					log.Error("%v", err)
 					http.Error(w, err.Error(), http.StatusBadRequest)
@@ -387,7 +378,7 @@ func (proxy *WebauthnFirewall) webauthnIsEnabled(w http.ResponseWriter, r *http.
 	vars := mux.Vars(r)
 	username := vars["user"]
 
-	isEnabled := db.WebauthnStore.IsUserEnabled(db.QueryByUsername(username))
+	isEnabled := proxy.storage.IsUserEnabled(db.QueryByUsername(username))
 
 	// Marshal a response `webauthn_is_enabled` field
 	json_response, err := json.Marshal(map[string]bool{"webauthn_is_enabled": isEnabled})
@@ -517,7 +508,7 @@ func (proxy *WebauthnFirewall) finishRegister(w http.ResponseWriter, r *http.Req
 	}
 
 	// Save the `wcredential` to the database
-	db.WebauthnStore.Create(wuser, wcredential)
+	proxy.storage.Create(wuser, wcredential, db.CredentialMetadata{RPID: "localhost"})
 
 	// Success!
 	w.WriteHeader(http.StatusOK)
@@ -531,7 +522,7 @@ func (proxy *WebauthnFirewall) beginAttestation_base(
 	w http.ResponseWriter, r *http.Request) {
 
 	// See if the user has webauthn enabled
-	isEnabled := db.WebauthnStore.IsUserEnabled(query)
+	isEnabled := proxy.storage.IsUserEnabled(query)
 
 	// Do nothing if the user does not have webauthn enabled
 	if !isEnabled {
@@ -540,7 +531,7 @@ func (proxy *WebauthnFirewall) beginAttestation_base(
 	}
 
 	// Get a `webauthnUser` from the input `query`
-	wuser, err := db.WebauthnStore.GetWebauthnUser(query)
+	wuser, err := proxy.storage.GetWebauthnUser(query)
 	if err != nil {
 		log.Error("%v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -667,12 +658,12 @@ func (proxy *WebauthnFirewall) finishLogin(w http.ResponseWriter, r *http.Reques
 	}
 
 	// See if the user has webauthn enabled
-	isEnabled := db.WebauthnStore.IsUserEnabled(db.QueryByUsername(reqBody.User.Username))
+	isEnabled := proxy.storage.IsUserEnabled(db.QueryByUsername(reqBody.User.Username))
 
 	// Perform a webauthn check if webauthn is enabled for this user
 	if isEnabled {
 		// Check the webauthn assertion for this operation. There are no extensions to verify
-		err = checkWebauthnAssertion(r, db.QueryByUsername(reqBody.User.Username), nil, reqBody.Assertion)
+		err = proxy.checkWebauthnAssertion(r, db.QueryByUsername(reqBody.User.Username), nil, reqBody.Assertion)
 		if err != nil {
 			log.Error("%v", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -720,7 +711,7 @@ func (proxy *WebauthnFirewall) disableWebauthn(w http.ResponseWriter, r *http.Re
 	query := db.QueryByUserID(userID)
 
 	// Get a `webauthnUser` for the `query`
-	wuser, err := db.WebauthnStore.GetWebauthnUser(query)
+	wuser, err := proxy.storage.GetWebauthnUser(query)
 	if err != nil {
 		log.Error("%v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -732,7 +723,7 @@ func (proxy *WebauthnFirewall) disableWebauthn(w http.ResponseWriter, r *http.Re
 	extensions["txAuthSimple"] = fmt.Sprintf("Confirm disable webauthn for %v", wuser.WebAuthnName())
 
 	// Check the webauthn assertion for this operation.
-	err = checkWebauthnAssertion(r, query, extensions, reqBody.Assertion)
+	err = proxy.checkWebauthnAssertion(r, query, extensions, reqBody.Assertion)
 	if err != nil {
 		log.Error("%v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -748,7 +739,7 @@ func (proxy *WebauthnFirewall) disableWebauthn(w http.ResponseWriter, r *http.Re
 	}
 
 	// Save the `credential` to the database
-	db.WebauthnStore.Delete(wuser.WebAuthnName())
+	proxy.storage.Delete(wuser.WebAuthnName())
 
 	// Success!
 	w.WriteHeader(http.StatusOK)
@@ -839,15 +830,32 @@ func (proxy *WebauthnFirewall) updateUser(r *http.Request) (protocol.Authenticat
 
 // TODO: A lot of these functions can be put into their own files such as the registration, log in, txAuthn handlers, util functions
 func main() {
-	// Initialize a new webauthn firewall
-	wfirewall := NewWebauthnFirewall()
+	secretFile := os.Getenv(ENV_JWT_SECRET_FILE)
+	if secretFile == "" {
+		log.Fatal("Set %s to the file holding the JWT secret of the Conduit backend", ENV_JWT_SECRET_FILE)
+	}
+
+	// Verify the JWTs issued by the backend, which are passed as "Token <jwt>"
+	var err error
+	jwtVerifier, err = wf.NewJWTVerifier(wf.JWTVerifierConfig{
+		Algorithms:     []string{"HS256"},
+		HMACSecretFile: secretFile,
+		UserIDClaim:    "id",
+	})
+	if err != nil {
+		log.Fatal("Unable to create JWT verifier from %s=%s: %v", ENV_JWT_SECRET_FILE, secretFile, err)
+	}
 
 	// Initialize the database for the firewall
 	log.Info("Starting up database")
-	if err := db.Init(); err != nil {
+	storage, err := db.NewStorage(db.Config{})
+	if err != nil {
 		panic("Unable to initialize database: " + err.Error())
 	}
 
+	// Initialize a new webauthn firewall
+	wfirewall := NewWebauthnFirewall(storage)
+
 	// Register the HTTP routes
 	r := mux.NewRouter()
 
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "unknwon.dev/clog/v2"
+
+	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
+)
+
+// Usage: go run migrate.go [-driver sqlite] [-dsn webauthn-firewall.db] [-rpid localhost] [-to VERSION] up|down|status
+
+func main() {
+	driver := flag.String("driver", db.DriverSQLite, "Storage driver: sqlite, postgres or mysql")
+	dsn := flag.String("dsn", "", "Data source name of the credential database")
+	rpID := flag.String("rpid", "", "RP ID to backfill into credentials stored without one")
+	to := flag.Int64("to", -1, "Target schema version. Defaults to the latest for up and 0 for down")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] up|down|status\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	config := db.Config{
+		Driver: *driver,
+		DSN:    *dsn,
+		RPID:   *rpID,
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "up":
+		target := *to
+		if target < 0 {
+			target = 0
+		}
+		err = db.MigrateUp(config, target)
+	case "down":
+		target := *to
+		if target < 0 {
+			target = 0
+		}
+		err = db.MigrateDown(config, target)
+	case "status":
+		var states []db.MigrationState
+		states, err = db.MigrationStatus(config)
+		for _, state := range states {
+			applied := " "
+			if state.Applied {
+				applied = "x"
+			}
+			fmt.Printf("[%s] %d %s\n", applied, state.Version, state.Name)
+		}
+	default:
+		err = fmt.Errorf("Unknown migrate command: %s", flag.Arg(0))
+	}
+
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	// Graceful stopping all loggers before exiting the program.
+	log.Stop()
+}
+
+func init() {
+	// Initialize the logger code
+	err := log.NewConsole()
+	if err != nil {
+		panic("Unable to create new logger: " + err.Error())
+	}
+}
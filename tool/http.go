@@ -6,20 +6,50 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
-func PerformRequestJSON(req *http.Request, responseBody interface{}) error {
+// Checks the TLS certificates of the servers, unlike `PerformRequest`. Use it for any
+// request whose response is trusted, such as the signing keys of an identity provider
+var verifiedClient = &http.Client{Timeout: 30 * time.Second}
+
+// Perform the `req`, leaving the handling of the response to the caller
+func PerformRequest(req *http.Request) (*http.Response, error) {
 	// TODO: Make this a confiruable option in the `initHTTP` function
 	tr := &http.Transport{
 		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
 		DisableKeepAlives: true,
 	}
 	client := &http.Client{Transport: tr}
-	resp, err := client.Do(req)
+	return client.Do(req)
+}
+
+// Perform the `req`, checking the TLS certificate of the server
+func PerformVerifiedRequest(req *http.Request) (*http.Response, error) {
+	return verifiedClient.Do(req)
+}
+
+func PerformRequestJSON(req *http.Request, responseBody interface{}) error {
+	resp, err := PerformRequest(req)
 	if err != nil {
 		return err
 	}
 
+	return decodeResponseJSON(resp, responseBody)
+}
+
+func PerformVerifiedRequestJSON(req *http.Request, responseBody interface{}) error {
+	resp, err := PerformVerifiedRequest(req)
+	if err != nil {
+		return err
+	}
+
+	return decodeResponseJSON(resp, responseBody)
+}
+
+func decodeResponseJSON(resp *http.Response, responseBody interface{}) error {
+	defer resp.Body.Close()
+
 	// Some sort of an error occurred at the server-side
 	if resp.StatusCode != http.StatusOK {
 		// The error text is inside of the `resp.Body`
@@ -27,7 +57,7 @@ func PerformRequestJSON(req *http.Request, responseBody interface{}) error {
 		return fmt.Errorf("%s", body)
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(responseBody)
+	err := json.NewDecoder(resp.Body).Decode(responseBody)
 	if err != nil {
 		return err
 	}
@@ -53,3 +83,13 @@ func GetRequestJSON(url string, responseBody interface{}) error {
 	// Success!
 	return nil
 }
+
+// Perform a simple GET request that expects a JSON response, checking the TLS certificate of the server
+func GetVerifiedRequestJSON(url string, responseBody interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	return PerformVerifiedRequestJSON(req, responseBody)
+}
@@ -0,0 +1,307 @@
+package webauthn_firewall
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "unknwon.dev/clog/v2"
+
+	"webauthn/protocol"
+	"webauthn/webauthn"
+)
+
+type AttestationPolicy struct {
+	// The attestation conveyance preference sent with every registration.
+	// One of `protocol.PreferNoAttestation`, `PreferIndirectAttestation` or `PreferDirectAttestation`
+	Conveyance protocol.ConveyancePreference
+
+	// When non-empty, only authenticators with one of these AAGUIDs may register. Requires
+	// a `TrustAnchorsFile` or `MetadataFile`, which vouch for the AAGUID of an authenticator
+	AllowAAGUIDs []string
+	// Authenticators with one of these AAGUIDs may never register. Requires a `TrustAnchorsFile`
+	// or `MetadataFile` as well, since a denied authenticator could otherwise claim any AAGUID
+	DenyAAGUIDs []string
+
+	// A PEM bundle of trust anchors which the attestation certificates must chain up to
+	TrustAnchorsFile string
+	// A FIDO MDS blob downloaded to disk. The root certificates and status reports of
+	// every entry are used to verify the attestation of the respective AAGUID
+	MetadataFile string
+}
+
+// The status reports of a FIDO MDS entry which disqualify an authenticator
+var undesiredAuthenticatorStatus = map[string]bool{
+	"ATTESTATION_KEY_COMPROMISE":   true,
+	"USER_VERIFICATION_BYPASS":     true,
+	"USER_KEY_REMOTE_COMPROMISE":   true,
+	"USER_KEY_PHYSICAL_COMPROMISE": true,
+	"REVOKED":                      true,
+}
+
+type attestationVerifier struct {
+	conveyance protocol.ConveyancePreference
+
+	allowAAGUIDs map[string]bool
+	denyAAGUIDs  map[string]bool
+
+	// Trust anchors applying to every AAGUID
+	trustAnchors *x509.CertPool
+	// Trust anchors and disqualifications from the FIDO MDS blob, keyed by AAGUID
+	metadataAnchors     map[string]*x509.CertPool
+	metadataUndesirable map[string]string
+}
+
+func newAttestationVerifier(policy AttestationPolicy) (*attestationVerifier, error) {
+	v := &attestationVerifier{
+		conveyance:   policy.Conveyance,
+		allowAAGUIDs: make(map[string]bool),
+		denyAAGUIDs:  make(map[string]bool),
+	}
+
+	for _, aaguid := range policy.AllowAAGUIDs {
+		v.allowAAGUIDs[strings.ToLower(aaguid)] = true
+	}
+
+	for _, aaguid := range policy.DenyAAGUIDs {
+		v.denyAAGUIDs[strings.ToLower(aaguid)] = true
+	}
+
+	if policy.TrustAnchorsFile != "" {
+		pemBundle, err := ioutil.ReadFile(policy.TrustAnchorsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		v.trustAnchors = x509.NewCertPool()
+		if !v.trustAnchors.AppendCertsFromPEM(pemBundle) {
+			return nil, fmt.Errorf("No certificates found in trust anchor bundle: %s", policy.TrustAnchorsFile)
+		}
+	}
+
+	if policy.MetadataFile != "" {
+		if err := v.loadMetadata(policy.MetadataFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without a certificate chain to check, the AAGUID is whatever the authenticator claims
+	if len(v.allowAAGUIDs) != 0 && v.trustAnchors == nil && v.metadataAnchors == nil {
+		return nil, fmt.Errorf("An AAGUID allow list requires trust anchors or a FIDO metadata file")
+	}
+	if len(v.denyAAGUIDs) != 0 && v.trustAnchors == nil && v.metadataAnchors == nil {
+		return nil, fmt.Errorf("An AAGUID deny list requires trust anchors or a FIDO metadata file")
+	}
+
+	// Authenticators do not reveal their AAGUID nor certificates without attestation
+	if v.needsAttestation() && (v.conveyance == "" || v.conveyance == protocol.PreferNoAttestation) {
+		return nil, fmt.Errorf("Attestation policy checks require indirect or direct attestation conveyance")
+	}
+
+	return v, nil
+}
+
+// Browsers zero the AAGUID without attestation, so even a deny list would never match
+func (v *attestationVerifier) needsAttestation() bool {
+	return len(v.allowAAGUIDs) != 0 || len(v.denyAAGUIDs) != 0 ||
+		v.trustAnchors != nil || v.metadataAnchors != nil
+}
+
+// Load the FIDO MDS blob at `filename`. The blob is a JWT whose payload holds the
+// metadata entries. Its signature is not checked since the file is provisioned by the operator
+func (v *attestationVerifier) loadMetadata(filename string) error {
+	blob, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(blob)), ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("Malformed FIDO MDS blob: %s", filename)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+
+	var metadata struct {
+		Entries []struct {
+			AAGUID            string `json:"aaguid"`
+			MetadataStatement struct {
+				AttestationRootCertificates []string `json:"attestationRootCertificates"`
+			} `json:"metadataStatement"`
+			StatusReports []struct {
+				Status string `json:"status"`
+			} `json:"statusReports"`
+		} `json:"entries"`
+	}
+	if err := json.Unmarshal(payload, &metadata); err != nil {
+		return err
+	}
+
+	v.metadataAnchors = make(map[string]*x509.CertPool)
+	v.metadataUndesirable = make(map[string]string)
+
+	for _, entry := range metadata.Entries {
+		// U2F authenticators are only identified by key identifiers
+		if entry.AAGUID == "" {
+			continue
+		}
+		aaguid := strings.ToLower(entry.AAGUID)
+
+		pool := x509.NewCertPool()
+		for _, encoded := range entry.MetadataStatement.AttestationRootCertificates {
+			der, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return err
+			}
+
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			pool.AddCert(cert)
+		}
+		v.metadataAnchors[aaguid] = pool
+
+		// Any undesirable status report disqualifies the authenticator
+		for _, report := range entry.StatusReports {
+			if undesiredAuthenticatorStatus[report.Status] {
+				v.metadataUndesirable[aaguid] = report.Status
+			}
+		}
+	}
+
+	log.Info("Loaded %d FIDO metadata entries from %s", len(v.metadataAnchors), filename)
+	return nil
+}
+
+func (v *attestationVerifier) registrationOptions() []webauthn.RegistrationOption {
+	if v.conveyance == "" {
+		return nil
+	}
+
+	return []webauthn.RegistrationOption{webauthn.WithConveyancePreference(v.conveyance)}
+}
+
+// Check the attestation of a registration `credentials` response against the policy
+func (v *attestationVerifier) verify(credentials string) error {
+	parsed, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(credentials))
+	if err != nil {
+		return err
+	}
+
+	attestation := parsed.Response.AttestationObject
+	return v.verifyAttestation(attestation.Format, attestation.AuthData.AttData.AAGUID, attestation.AttStatement)
+}
+
+// Check an attestation of `format` by the authenticator model `rawAAGUID` with the `attStatement`
+func (v *attestationVerifier) verifyAttestation(format string, rawAAGUID []byte, attStatement map[string]interface{}) error {
+	aaguid := formatAAGUID(rawAAGUID)
+
+	if v.denyAAGUIDs[aaguid] {
+		return fmt.Errorf("Authenticator model is not permitted: %s", aaguid)
+	}
+
+	// A zeroed AAGUID hides the authenticator model, so it cannot be checked against a deny list
+	if len(v.denyAAGUIDs) != 0 && bytes.Equal(rawAAGUID, make([]byte, len(rawAAGUID))) {
+		return fmt.Errorf("Authenticator model is unknown, but a deny list is configured")
+	}
+
+	if len(v.allowAAGUIDs) != 0 && !v.allowAAGUIDs[aaguid] {
+		return fmt.Errorf("Authenticator model is not on the allow list: %s", aaguid)
+	}
+
+	if status, ok := v.metadataUndesirable[aaguid]; ok {
+		return fmt.Errorf("Authenticator model has status %s: %s", status, aaguid)
+	}
+
+	// Pick the trust anchors which apply to this AAGUID
+	roots := v.trustAnchors
+	if pool, ok := v.metadataAnchors[aaguid]; ok {
+		roots = pool
+	} else if v.metadataAnchors != nil && roots == nil {
+		return fmt.Errorf("Authenticator model not found in metadata: %s", aaguid)
+	}
+
+	// There is no certificate chain to check
+	if roots == nil {
+		// The AAGUID of a `none` or self attestation is self-asserted, so it can pass neither list
+		if len(v.allowAAGUIDs) != 0 || len(v.denyAAGUIDs) != 0 {
+			return fmt.Errorf("Authenticator model %s requires a trusted attestation", aaguid)
+		}
+		return nil
+	}
+
+	// Verify that the attestation certificate chains up to the `roots`
+	x5c, ok := attStatement["x5c"].([]interface{})
+	if !ok || len(x5c) == 0 {
+		return fmt.Errorf("Attestation of format %s carries no certificate", format)
+	}
+
+	certs := make([]*x509.Certificate, len(x5c))
+	for idx, raw := range x5c {
+		der, ok := raw.([]byte)
+		if !ok {
+			return fmt.Errorf("Malformed attestation certificate")
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs[idx] = cert
+	}
+
+	// The attestation certificate may name the AAGUID of the authenticator, which must then match
+	if err := checkCertificateAAGUID(certs[0], rawAAGUID); err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("Attestation certificate is not trusted: %v", err)
+	}
+
+	// Success!
+	return nil
+}
+
+// The id-fido-gen-ce-aaguid certificate extension
+var oidFIDOGenCEAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Check that the id-fido-gen-ce-aaguid extension of the `cert`, if it has one, holds the `aaguid`
+func checkCertificateAAGUID(cert *x509.Certificate, aaguid []byte) error {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidFIDOGenCEAAGUID) {
+			continue
+		}
+
+		var certAAGUID []byte
+		if _, err := asn1.Unmarshal(ext.Value, &certAAGUID); err != nil {
+			return fmt.Errorf("Malformed AAGUID extension of the attestation certificate: %v", err)
+		}
+
+		if !bytes.Equal(certAAGUID, aaguid) {
+			return fmt.Errorf("Attestation certificate is for authenticator model %s, not %s",
+				formatAAGUID(certAAGUID), formatAAGUID(aaguid))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package webauthn_firewall
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"webauthn/protocol"
+)
+
+var (
+	deniedAAGUID  = []byte{0xde, 0x11, 0xed, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	allowedAAGUID = []byte{0xa1, 0x10, 0xed, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	zeroedAAGUID  = make([]byte, 16)
+)
+
+type testCertificateAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertificateAuthority(t *testing.T, name string) *testCertificateAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificateAuthority{cert: cert, key: key}
+}
+
+// Issue an attestation certificate, naming the `aaguid` in its extension unless it is nil
+func (ca *testCertificateAuthority) issue(t *testing.T, aaguid []byte) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Authenticator Attestation"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	if aaguid != nil {
+		value, err := asn1.Marshal(aaguid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidFIDOGenCEAAGUID, Value: value}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func (ca *testCertificateAuthority) writePEM(t *testing.T, dir string) string {
+	filename := filepath.Join(dir, "anchors.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := ioutil.WriteFile(filename, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestNewAttestationVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attestation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	anchors := newTestCertificateAuthority(t, "Root").writePEM(t, dir)
+
+	tests := []struct {
+		name    string
+		policy  AttestationPolicy
+		wantErr string
+	}{
+		{
+			name:   "no policy",
+			policy: AttestationPolicy{},
+		},
+		{
+			name: "allow list without trust anchors",
+			policy: AttestationPolicy{
+				Conveyance:   protocol.PreferDirectAttestation,
+				AllowAAGUIDs: []string{formatAAGUID(allowedAAGUID)},
+			},
+			wantErr: "allow list requires trust anchors",
+		},
+		{
+			name: "deny list without trust anchors",
+			policy: AttestationPolicy{
+				Conveyance:  protocol.PreferDirectAttestation,
+				DenyAAGUIDs: []string{formatAAGUID(deniedAAGUID)},
+			},
+			wantErr: "deny list requires trust anchors",
+		},
+		{
+			name: "deny list without attestation conveyance",
+			policy: AttestationPolicy{
+				DenyAAGUIDs:      []string{formatAAGUID(deniedAAGUID)},
+				TrustAnchorsFile: anchors,
+			},
+			wantErr: "conveyance",
+		},
+		{
+			name: "deny list with trust anchors",
+			policy: AttestationPolicy{
+				Conveyance:       protocol.PreferDirectAttestation,
+				DenyAAGUIDs:      []string{formatAAGUID(deniedAAGUID)},
+				TrustAnchorsFile: anchors,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newAttestationVerifier(test.policy)
+
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Expected an error containing %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAttestationVerifier_DenyList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attestation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := newTestCertificateAuthority(t, "Root")
+	untrusted := newTestCertificateAuthority(t, "Untrusted")
+
+	verifier, err := newAttestationVerifier(AttestationPolicy{
+		Conveyance:       protocol.PreferDirectAttestation,
+		DenyAAGUIDs:      []string{formatAAGUID(deniedAAGUID)},
+		TrustAnchorsFile: root.writePEM(t, dir),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		format       string
+		aaguid       []byte
+		attStatement map[string]interface{}
+		wantErr      string
+	}{
+		{
+			name:         "trusted attestation",
+			format:       "packed",
+			aaguid:       allowedAAGUID,
+			attStatement: map[string]interface{}{"x5c": []interface{}{root.issue(t, allowedAAGUID)}},
+		},
+		{
+			name:         "trusted attestation without the AAGUID extension",
+			format:       "packed",
+			aaguid:       allowedAAGUID,
+			attStatement: map[string]interface{}{"x5c": []interface{}{root.issue(t, nil)}},
+		},
+		{
+			name:         "denied model",
+			format:       "packed",
+			aaguid:       deniedAAGUID,
+			attStatement: map[string]interface{}{"x5c": []interface{}{root.issue(t, deniedAAGUID)}},
+			wantErr:      "not permitted",
+		},
+		{
+			name:         "denied model claiming another AAGUID",
+			format:       "packed",
+			aaguid:       allowedAAGUID,
+			attStatement: map[string]interface{}{"x5c": []interface{}{root.issue(t, deniedAAGUID)}},
+			wantErr:      "Attestation certificate is for authenticator model",
+		},
+		{
+			name:         "zeroed AAGUID",
+			format:       "packed",
+			aaguid:       zeroedAAGUID,
+			attStatement: map[string]interface{}{"x5c": []interface{}{root.issue(t, nil)}},
+			wantErr:      "model is unknown",
+		},
+		{
+			name:         "none attestation",
+			format:       "none",
+			aaguid:       allowedAAGUID,
+			attStatement: map[string]interface{}{},
+			wantErr:      "carries no certificate",
+		},
+		{
+			name:         "self attestation",
+			format:       "packed",
+			aaguid:       allowedAAGUID,
+			attStatement: map[string]interface{}{"alg": int64(-7), "sig": []byte{1, 2, 3}},
+			wantErr:      "carries no certificate",
+		},
+		{
+			name:         "untrusted attestation",
+			format:       "packed",
+			aaguid:       allowedAAGUID,
+			attStatement: map[string]interface{}{"x5c": []interface{}{untrusted.issue(t, allowedAAGUID)}},
+			wantErr:      "not trusted",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifier.verifyAttestation(test.format, test.aaguid, test.attStatement)
+
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Expected an error containing %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+// Even when a verifier lacks trust anchors, a self-asserted AAGUID may not pass its deny list
+func TestAttestationVerifier_DenyListWithoutAnchors(t *testing.T) {
+	verifier := &attestationVerifier{
+		conveyance:   protocol.PreferDirectAttestation,
+		allowAAGUIDs: map[string]bool{},
+		denyAAGUIDs:  map[string]bool{formatAAGUID(deniedAAGUID): true},
+	}
+
+	for _, aaguid := range [][]byte{allowedAAGUID, zeroedAAGUID, deniedAAGUID} {
+		err := verifier.verifyAttestation("none", aaguid, map[string]interface{}{})
+		if err == nil {
+			t.Errorf("Expected the none attestation of %s to be refused", formatAAGUID(aaguid))
+		}
+	}
+}
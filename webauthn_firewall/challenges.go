@@ -0,0 +1,21 @@
+package webauthn_firewall
+
+import (
+	"time"
+
+	"webauthn/webauthn"
+)
+
+// How long an issued challenge may be used for, unless configured otherwise
+const defaultChallengeTTL = 5 * time.Minute
+
+// Record the challenge of a ceremony which just began, so that it can only be used once
+func (wfirewall *WebauthnFirewall) issueChallenge(sessionData *webauthn.SessionData) error {
+	return wfirewall.challengeStore.IssueChallenge(sessionData.Challenge, time.Now().Add(wfirewall.challengeTTL))
+}
+
+// Invalidate the challenge of the ceremony being finished. The session cookie holding the
+// challenge remains valid until it expires, so this is what rules out replaying it
+func (wfirewall *WebauthnFirewall) consumeChallenge(sessionData webauthn.SessionData) error {
+	return wfirewall.challengeStore.ConsumeChallenge(sessionData.Challenge)
+}
@@ -0,0 +1,949 @@
+package webauthn_firewall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
+	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/tool"
+
+	"webauthn/protocol"
+)
+
+// The declarative configuration of a `WebauthnFirewall`, loaded from a YAML or JSON file.
+// It describes everything which the per-app Go binaries otherwise compile in
+type FileConfig struct {
+	RPDisplayName string `json:"rp_display_name" yaml:"rp_display_name"`
+	RPID          string `json:"rp_id" yaml:"rp_id"`
+
+	FrontendAddress     string              `json:"frontend_address" yaml:"frontend_address"`
+	ReverseProxyAddress string              `json:"reverse_proxy_address" yaml:"reverse_proxy_address"`
+	ProxyTargets        []ProxyTargetConfig `json:"proxy_targets" yaml:"proxy_targets"`
+	TLS                 TLSConfig           `json:"tls" yaml:"tls"`
+
+	Identity       IdentityConfig                 `json:"identity" yaml:"identity"`
+	ContextGetters map[string]ContextGetterConfig `json:"context_getters" yaml:"context_getters"`
+
+	Database           DatabaseConfig          `json:"database" yaml:"database"`
+	CloneWarningPolicy string                  `json:"clone_warning_policy" yaml:"clone_warning_policy"`
+	Attestation        AttestationPolicyConfig `json:"attestation" yaml:"attestation"`
+	Challenges         ChallengesConfig        `json:"challenges" yaml:"challenges"`
+	Sessions           SessionsConfig          `json:"sessions" yaml:"sessions"`
+
+	WebauthnCorePrefix string `json:"webauthn_core_prefix" yaml:"webauthn_core_prefix"`
+	LoginURL           string `json:"login_url" yaml:"login_url"`
+	// The field path of the username in the body of the `LoginURL` requests, i.e. [user, username]
+	LoginUsernameField []string `json:"login_username_field" yaml:"login_username_field"`
+
+	Routes          []RouteConfig         `json:"routes" yaml:"routes"`
+	UnmatchedRoutes UnmatchedRoutesConfig `json:"unmatched_routes" yaml:"unmatched_routes"`
+	// Routes which are refused before any other, such as the internal endpoints of the backend
+	DeniedRoutes []RoutePatternConfig `json:"denied_routes" yaml:"denied_routes"`
+	// Bind the assertions of every route to a digest of the entire request
+	BindRequestBody bool `json:"bind_request_body" yaml:"bind_request_body"`
+
+	// The largest body in bytes which the routes inspect, and the size above which it is spilled to disk.
+	// Bodies of requests which are only proxied are never buffered
+	MaxBodySize     int64 `json:"max_body_size" yaml:"max_body_size"`
+	BodyMemoryLimit int64 `json:"body_memory_limit" yaml:"body_memory_limit"`
+
+	// The loopback address of the admin endpoint which reloads the routes
+	AdminAddress string `json:"admin_address" yaml:"admin_address"`
+
+	SupplyOptions bool `json:"supply_options" yaml:"supply_options"`
+	Verbose       bool `json:"verbose" yaml:"verbose"`
+
+	// The file the configuration was loaded from, which reloads read again
+	filename string
+}
+
+type ProxyTargetConfig struct {
+	// The host of the incoming requests, i.e. "localhost:8081"
+	Host        string `json:"host" yaml:"host"`
+	Destination string `json:"destination" yaml:"destination"`
+	// How the request bodies of this target are parsed. One of "form" or "json"
+	Input string `json:"input" yaml:"input"`
+}
+
+type TLSConfig struct {
+	Cert string `json:"cert" yaml:"cert"`
+	Key  string `json:"key" yaml:"key"`
+}
+
+type DatabaseConfig struct {
+	Driver string `json:"driver" yaml:"driver"`
+	DSN    string `json:"dsn" yaml:"dsn"`
+}
+
+type ChallengesConfig struct {
+	// One of "database", which is shared by every replica, or "memory"
+	Store string `json:"store" yaml:"store"`
+	TTL   string `json:"ttl" yaml:"ttl"`
+}
+
+type SessionsConfig struct {
+	// One of "cookie", which is keyed by the SESSION_KEY environment variable, "memory" or "database"
+	Store string `json:"store" yaml:"store"`
+	TTL   string `json:"ttl" yaml:"ttl"`
+}
+
+type AttestationPolicyConfig struct {
+	Conveyance       string   `json:"conveyance" yaml:"conveyance"`
+	AllowAAGUIDs     []string `json:"allow_aaguids" yaml:"allow_aaguids"`
+	DenyAAGUIDs      []string `json:"deny_aaguids" yaml:"deny_aaguids"`
+	TrustAnchorsFile string   `json:"trust_anchors_file" yaml:"trust_anchors_file"`
+	MetadataFile     string   `json:"metadata_file" yaml:"metadata_file"`
+}
+
+// Selects one of the built-in `IdentityProvider`s by its `Type`, configured by the field of the same name
+type IdentityConfig struct {
+	// One of "backend", "jwt", "header" or "introspection"
+	Type string `json:"type" yaml:"type"`
+
+	Backend struct {
+		URL            string   `json:"url" yaml:"url"`
+		Method         string   `json:"method" yaml:"method"`
+		ForwardCookies bool     `json:"forward_cookies" yaml:"forward_cookies"`
+		ForwardHeaders []string `json:"forward_headers" yaml:"forward_headers"`
+		UserIDPath     string   `json:"user_id_path" yaml:"user_id_path"`
+		OkPath         string   `json:"ok_path" yaml:"ok_path"`
+		CacheTTL       string   `json:"cache_ttl" yaml:"cache_ttl"`
+	} `json:"backend" yaml:"backend"`
+
+	JWT struct {
+		Algorithms     []string `json:"algorithms" yaml:"algorithms"`
+		HMACSecretFile string   `json:"hmac_secret_file" yaml:"hmac_secret_file"`
+		PublicKeyFile  string   `json:"public_key_file" yaml:"public_key_file"`
+		JWKS           string   `json:"jwks" yaml:"jwks"`
+		Issuer         string   `json:"issuer" yaml:"issuer"`
+		Audience       string   `json:"audience" yaml:"audience"`
+		UserIDClaim    string   `json:"user_id_claim" yaml:"user_id_claim"`
+		HeaderName     string   `json:"header_name" yaml:"header_name"`
+		CacheTTL       string   `json:"cache_ttl" yaml:"cache_ttl"`
+	} `json:"jwt" yaml:"jwt"`
+
+	Header struct {
+		HeaderName     string   `json:"header_name" yaml:"header_name"`
+		TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"`
+	} `json:"header" yaml:"header"`
+
+	Introspection struct {
+		Endpoint     string `json:"endpoint" yaml:"endpoint"`
+		ClientID     string `json:"client_id" yaml:"client_id"`
+		ClientSecret string `json:"client_secret" yaml:"client_secret"`
+		UserIDPath   string `json:"user_id_path" yaml:"user_id_path"`
+		HeaderName   string `json:"header_name" yaml:"header_name"`
+		CacheTTL     string `json:"cache_ttl" yaml:"cache_ttl"`
+	} `json:"introspection" yaml:"introspection"`
+}
+
+// A context getter which fetches a JSON object from an HTTP endpoint. The `URL` refers
+// to the arguments of the getter by their position, i.e. ".../server_context/webhook/{0}/{1}/{2}"
+type ContextGetterConfig struct {
+	URL   string `json:"url" yaml:"url"`
+	NArgs int    `json:"nargs" yaml:"nargs"`
+}
+
+type RouteConfig struct {
+	Method string `json:"method" yaml:"method"`
+	Path   string `json:"path" yaml:"path"`
+
+	// The methods to answer the OPTIONS requests of this route with
+	Options                 []string `json:"options" yaml:"options"`
+	RequireUserVerification bool     `json:"require_user_verification" yaml:"require_user_verification"`
+	BindRequestBody         bool     `json:"bind_request_body" yaml:"bind_request_body"`
+	// The largest body in bytes which this route inspects, in place of the global `max_body_size`
+	MaxBodySize int64 `json:"max_body_size" yaml:"max_body_size"`
+
+	// The authn text and operations applying to every request of this route
+	RuleConfig `json:",inline" yaml:",inline"`
+
+	// Alternatively, pick the rule by the value of an input. Unmatched requests are refused
+	Dispatch *DispatchConfig `json:"dispatch" yaml:"dispatch"`
+	// Or pick the rule by the mutation of a GraphQL endpoint. Unmatched operations are proxied.
+	// The GET requests of the `Path` are routed as well, and refused when they carry a mutation
+	GraphQL *GraphQLConfig `json:"graphql" yaml:"graphql"`
+}
+
+type RuleConfig struct {
+	// The authn text as a `fmt` format string, filled in by the `Ops`
+	Text string     `json:"text" yaml:"text"`
+	Ops  []OpConfig `json:"ops" yaml:"ops"`
+
+	// Proxy the requests without an assertion instead, i.e. as the `Default` of a dispatch
+	Proxy bool `json:"proxy" yaml:"proxy"`
+}
+
+type UnmatchedRoutesConfig struct {
+	// One of "allow", "deny" or "assert". Defaults to "allow"
+	Policy     string               `json:"policy" yaml:"policy"`
+	Methods    []string             `json:"methods" yaml:"methods"`
+	Exemptions []RoutePatternConfig `json:"exemptions" yaml:"exemptions"`
+	AuthnText  string               `json:"authn_text" yaml:"authn_text"`
+}
+
+type RoutePatternConfig struct {
+	Method string `json:"method" yaml:"method"`
+	Path   string `json:"path" yaml:"path"`
+}
+
+// The value of the input `On` picks one of the `Cases`. Since the client chooses the value, requests
+// matching none of the `Cases` are refused, unless a `Default` rule applies to them. Requests are only
+// proxied without an assertion when the `Default` says so with `proxy: true`
+type DispatchConfig struct {
+	On      OpConfig              `json:"on" yaml:"on"`
+	Cases   map[string]RuleConfig `json:"cases" yaml:"cases"`
+	Default *RuleConfig           `json:"default" yaml:"default"`
+}
+
+type GraphQLConfig struct {
+	// The rules by the name of the root field of the mutation
+	Mutations map[string]RuleConfig `json:"mutations" yaml:"mutations"`
+	// The rule of the mutations which select none of the `Mutations`
+	Default *RuleConfig `json:"default" yaml:"default"`
+}
+
+// A single DSL operation. Exactly one of `Get`, `UserID`, `Var`, `Context`,
+// `SetVar`, `SetContext` or `Log` selects the kind of the operation
+type OpConfig struct {
+	// `Get` an input `field`. The `Source` is one of "form", "json", "url", "url_param", "header",
+	// "cookie", "multipart", "multipart_file", "graphql_var" or "graphql_arg", or the default input
+	// of the proxy target when empty. A "graphql_arg" is an argument of the mutation of a `graphql` route.
+	// The `Type` is one of "string", "int64" or "array", and defaults to "string". A "multipart_file"
+	// takes one of "filename", "size", "content_type" or "sha256" as its sub field, or is described in full
+	Get    string `json:"get" yaml:"get"`
+	Source string `json:"source" yaml:"source"`
+	Type   string `json:"type" yaml:"type"`
+
+	UserID bool `json:"user_id" yaml:"user_id"`
+
+	Var        string `json:"var" yaml:"var"`
+	Context    string `json:"context" yaml:"context"`
+	SetVar     string `json:"set_var" yaml:"set_var"`
+	SetContext string `json:"set_context" yaml:"set_context"`
+	Log        string `json:"log" yaml:"log"`
+
+	// The sub fields to descend into of a `Get`, `Var` or `Context` result
+	SubFields []string `json:"sub_fields" yaml:"sub_fields"`
+	// The arguments of a `Context`, `SetContext` or `Log`
+	Args []OpConfig `json:"args" yaml:"args"`
+	// The value of a `SetVar`
+	Value *OpConfig `json:"value" yaml:"value"`
+}
+
+// Load the firewall configuration from `filename`. The format is picked by
+// the file extension, which is either ".yaml", ".yml" or ".json"
+func LoadConfigFile(filename string) (*FileConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(FileConfig)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, config)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	default:
+		err = fmt.Errorf("Unknown configuration file format: %s", filename)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", filename, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration %s: %v", filename, err)
+	}
+	config.filename = filename
+
+	// Success!
+	return config, nil
+}
+
+// Check everything which can be checked without starting up the firewall
+func (c *FileConfig) Validate() error {
+	if len(c.ProxyTargets) == 0 {
+		return fmt.Errorf("No proxy targets configured")
+	}
+
+	for _, target := range c.ProxyTargets {
+		if _, err := inputFnFromName(target.Input); err != nil {
+			return err
+		}
+	}
+
+	if _, err := cloneWarningPolicyFromName(c.CloneWarningPolicy); err != nil {
+		return err
+	}
+
+	if err := c.Identity.validate(); err != nil {
+		return err
+	}
+
+	if _, err := c.Challenges.challengeStore(); err != nil {
+		return err
+	}
+
+	if _, err := parseCacheTTL(c.Challenges.TTL); err != nil {
+		return err
+	}
+
+	if _, err := c.Sessions.sessionConfig(); err != nil {
+		return err
+	}
+
+	unmatchedRoutes, err := c.UnmatchedRoutes.policy()
+	if err != nil {
+		return err
+	}
+
+	if err := unmatchedRoutes.validate(); err != nil {
+		return err
+	}
+
+	for _, denied := range c.deniedRoutes() {
+		if err := denied.validate(); err != nil {
+			return fmt.Errorf("Malformed denied route %s: %v", denied.Path, err)
+		}
+	}
+
+	for _, route := range c.Routes {
+		if _, err := route.compile(nil); err != nil {
+			return fmt.Errorf("Route %s %s: %v", route.Method, route.Path, err)
+		}
+	}
+
+	return nil
+}
+
+func inputFnFromName(name string) (getInputFnType, error) {
+	switch name {
+	case "form", "":
+		return GetFormInput, nil
+	case "json":
+		return GetJSONInput, nil
+	}
+
+	return nil, fmt.Errorf("Unknown proxy target input: %s", name)
+}
+
+func cloneWarningPolicyFromName(name string) (CloneWarningPolicy, error) {
+	switch name {
+	case "reject", "":
+		return CloneWarningReject, nil
+	case "flag":
+		return CloneWarningFlag, nil
+	}
+
+	return CloneWarningReject, fmt.Errorf("Unknown clone warning policy: %s", name)
+}
+
+// Select the `ChallengeStore`, where nil stands for the credential database
+func (c ChallengesConfig) challengeStore() (db.ChallengeStore, error) {
+	switch c.Store {
+	case "database", "":
+		return nil, nil
+	case "memory":
+		return db.NewMemoryChallengeStore(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown challenge store: %s", c.Store)
+}
+
+func (c SessionsConfig) sessionConfig() (SessionConfig, error) {
+	var config SessionConfig
+	switch c.Store {
+	case "cookie", "":
+		config.Store = SessionStoreCookie
+	case "memory":
+		config.Store = SessionStoreMemory
+	case "database":
+		config.Store = SessionStoreDatabase
+	default:
+		return config, fmt.Errorf("Unknown session store: %s", c.Store)
+	}
+
+	ttl, err := parseCacheTTL(c.TTL)
+	config.TTL = ttl
+	return config, err
+}
+
+func (c UnmatchedRoutesConfig) policy() (UnmatchedRoutesPolicy, error) {
+	policy := UnmatchedRoutesPolicy{
+		Methods:   c.Methods,
+		AuthnText: c.AuthnText,
+	}
+
+	switch c.Policy {
+	case "allow", "":
+		policy.Policy = UnmatchedAllow
+	case "deny":
+		policy.Policy = UnmatchedDeny
+	case "assert":
+		policy.Policy = UnmatchedAssert
+	default:
+		return policy, fmt.Errorf("Unknown unmatched routes policy: %s", c.Policy)
+	}
+
+	for _, exemption := range c.Exemptions {
+		policy.Exemptions = append(policy.Exemptions, exemption.pattern())
+	}
+
+	return policy, nil
+}
+
+func (c RoutePatternConfig) pattern() RoutePattern {
+	return RoutePattern{
+		Method: c.Method,
+		Path:   c.Path,
+	}
+}
+
+func (c *FileConfig) deniedRoutes() []RoutePattern {
+	var patterns []RoutePattern
+	for _, denied := range c.DeniedRoutes {
+		patterns = append(patterns, denied.pattern())
+	}
+	return patterns
+}
+
+func parseCacheTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(ttl)
+}
+
+// Check the identity provider without contacting any of its endpoints
+func (c IdentityConfig) validate() error {
+	switch c.Type {
+	case "jwt":
+		return checkJWKSLocation(c.JWT.JWKS)
+	case "introspection":
+		return checkIntrospectionEndpoint(c.Introspection.Endpoint)
+	}
+
+	return nil
+}
+
+func (c IdentityConfig) identityProvider() (IdentityProvider, error) {
+	switch c.Type {
+	case "backend":
+		cacheTTL, err := parseCacheTTL(c.Backend.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewBackendIdentityProvider(BackendIdentityConfig{
+			URL:            c.Backend.URL,
+			Method:         c.Backend.Method,
+			ForwardCookies: c.Backend.ForwardCookies,
+			ForwardHeaders: c.Backend.ForwardHeaders,
+			UserIDPath:     c.Backend.UserIDPath,
+			OkPath:         c.Backend.OkPath,
+			CacheTTL:       cacheTTL,
+		})
+	case "jwt":
+		cacheTTL, err := parseCacheTTL(c.JWT.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewJWTVerifier(JWTVerifierConfig{
+			Algorithms:     c.JWT.Algorithms,
+			HMACSecretFile: c.JWT.HMACSecretFile,
+			PublicKeyFile:  c.JWT.PublicKeyFile,
+			JWKS:           c.JWT.JWKS,
+			Issuer:         c.JWT.Issuer,
+			Audience:       c.JWT.Audience,
+			UserIDClaim:    c.JWT.UserIDClaim,
+			HeaderName:     c.JWT.HeaderName,
+			CacheTTL:       cacheTTL,
+		})
+	case "header":
+		return NewHeaderIdentityProvider(HeaderIdentityConfig{
+			HeaderName:     c.Header.HeaderName,
+			TrustedProxies: c.Header.TrustedProxies,
+		})
+	case "introspection":
+		cacheTTL, err := parseCacheTTL(c.Introspection.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewIntrospectionIdentityProvider(IntrospectionIdentityConfig{
+			Endpoint:     c.Introspection.Endpoint,
+			ClientID:     c.Introspection.ClientID,
+			ClientSecret: c.Introspection.ClientSecret,
+			UserIDPath:   c.Introspection.UserIDPath,
+			HeaderName:   c.Introspection.HeaderName,
+			CacheTTL:     cacheTTL,
+		})
+	}
+
+	return nil, fmt.Errorf("Unknown identity provider type: %s", c.Type)
+}
+
+// Fetch the context of the `args` from the HTTP endpoint of `config`
+func httpContextGetter(name string, config ContextGetterConfig) func(...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		// Sanity check the input
+		if len(args) != config.NArgs {
+			return nil, fmt.Errorf("%s context expects %d arguments, received: %v", name, config.NArgs, args)
+		}
+
+		// Substitute the URL escaped `args` into the URL
+		contextURL := config.URL
+		for idx, v := range args {
+			placeholder := fmt.Sprintf("{%d}", idx)
+			contextURL = strings.Replace(contextURL, placeholder, url.PathEscape(fmt.Sprintf("%v", v)), -1)
+		}
+
+		itemMap := make(StructContext)
+		err := tool.GetRequestJSON(contextURL, &itemMap)
+
+		return itemMap, err
+	}
+}
+
+// Build the `WebauthnFirewallConfig` described by the file configuration
+func (c *FileConfig) firewallConfig() (*WebauthnFirewallConfig, error) {
+	var targets proxyTargetMap
+	for _, target := range c.ProxyTargets {
+		inputFn, err := inputFnFromName(target.Input)
+		if err != nil {
+			return nil, err
+		}
+
+		if targets == nil {
+			targets = NewProxyTarget(target.Host, target.Destination, inputFn)
+		} else {
+			targets.AnotherTarget(target.Host, target.Destination, inputFn)
+		}
+	}
+
+	identityProvider, err := c.Identity.identityProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	cloneWarningPolicy, err := cloneWarningPolicyFromName(c.CloneWarningPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	challengeStore, err := c.Challenges.challengeStore()
+	if err != nil {
+		return nil, err
+	}
+
+	challengeTTL, err := parseCacheTTL(c.Challenges.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := c.Sessions.sessionConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	unmatchedRoutes, err := c.UnmatchedRoutes.policy()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &WebauthnFirewallConfig{
+		RPDisplayName: c.RPDisplayName,
+		RPID:          c.RPID,
+
+		FrontendAddress:       c.FrontendAddress,
+		ReverseProxyTargetMap: targets,
+		ReverseProxyAddress:   c.ReverseProxyAddress,
+
+		IdentityProvider: identityProvider,
+		ContextGetters:   c.contextGetters(),
+
+		Database: db.Config{
+			Driver: c.Database.Driver,
+			DSN:    c.Database.DSN,
+		},
+		ChallengeStore: challengeStore,
+		ChallengeTTL:   challengeTTL,
+		Sessions:       sessions,
+
+		WebauthnCorePrefix: c.WebauthnCorePrefix,
+		LoginURL:           c.LoginURL,
+
+		CloneWarningPolicy: cloneWarningPolicy,
+		Attestation: AttestationPolicy{
+			Conveyance:       protocol.ConveyancePreference(c.Attestation.Conveyance),
+			AllowAAGUIDs:     c.Attestation.AllowAAGUIDs,
+			DenyAAGUIDs:      c.Attestation.DenyAAGUIDs,
+			TrustAnchorsFile: c.Attestation.TrustAnchorsFile,
+			MetadataFile:     c.Attestation.MetadataFile,
+		},
+
+		UnmatchedRoutes: unmatchedRoutes,
+		DeniedRoutes:    c.deniedRoutes(),
+		BindRequestBody: c.BindRequestBody,
+
+		MaxBodySize:     c.MaxBodySize,
+		BodyMemoryLimit: c.BodyMemoryLimit,
+
+		AdminAddress: c.AdminAddress,
+
+		SupplyOptions: c.SupplyOptions,
+		Verbose:       c.Verbose,
+	}
+
+	if len(c.LoginUsernameField) != 0 {
+		usernameField := c.LoginUsernameField
+		config.LoginGetUsername = func(r *ExtendedRequest) (string, error) {
+			return r.Get_WithErr(usernameField...)
+		}
+	}
+
+	return config, nil
+}
+
+// Create a `WebauthnFirewall` with every route of the file configuration registered
+func (c *FileConfig) NewWebauthnFirewall() (*WebauthnFirewall, error) {
+	config, err := c.firewallConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	wfirewall := NewWebauthnFirewall(config)
+
+	if err := c.registerRoutes(wfirewall); err != nil {
+		return nil, err
+	}
+
+	// Reloads read the routes and context getters from the file again. Every other
+	// setting, such as the proxy targets or identity provider, needs a restart
+	if c.filename != "" {
+		wfirewall.SetRulesSource(func(wfirewall *WebauthnFirewall) error {
+			reloaded, err := LoadConfigFile(c.filename)
+			if err != nil {
+				return err
+			}
+
+			return reloaded.registerRoutes(wfirewall)
+		})
+	}
+
+	// Success!
+	return wfirewall, nil
+}
+
+func (c *FileConfig) contextGetters() ContextGettersType {
+	contextGetters := make(ContextGettersType)
+	for name, getter := range c.ContextGetters {
+		contextGetters[name] = httpContextGetter(name, getter)
+	}
+	return contextGetters
+}
+
+// Register every route of the file configuration along with the context getters they use
+func (c *FileConfig) registerRoutes(wfirewall *WebauthnFirewall) error {
+	wfirewall.contextGetters = c.contextGetters()
+
+	for _, route := range c.Routes {
+		handleFn, err := route.compile(wfirewall)
+		if err != nil {
+			return fmt.Errorf("Route %s %s: %v", route.Method, route.Path, err)
+		}
+
+		wfirewall.Secure(route.Method, route.Path, handleFn, route.secureArgs()...)
+
+		// A GraphQL endpoint may also take operations in the URL of a GET request, so those
+		// are routed by the same handler, unless the GET requests have a route of their own
+		if route.GraphQL != nil && route.Method != "GET" && !c.hasRoute("GET", route.Path) {
+			wfirewall.Secure("GET", route.Path, handleFn, route.secureArgs()...)
+		}
+	}
+
+	return nil
+}
+
+func (c *FileConfig) hasRoute(method, path string) bool {
+	for _, route := range c.Routes {
+		if route.Method == method && route.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (route RouteConfig) secureArgs() []FirewallSecureArgs {
+	var args []FirewallSecureArgs
+	if len(route.Options) != 0 {
+		args = append(args, CustomOptions(route.Options...))
+	}
+	if route.RequireUserVerification {
+		args = append(args, RequireUserVerification())
+	}
+	if route.BindRequestBody {
+		args = append(args, BindRequestBody())
+	}
+	if route.MaxBodySize > 0 {
+		args = append(args, MaxBodySize(route.MaxBodySize))
+	}
+	return args
+}
+
+// Compile the `route` into its handler. A nil `wfirewall` only checks the route
+func (route RouteConfig) compile(wfirewall *WebauthnFirewall) (HandlerFnType, error) {
+	if route.Method == "" || route.Path == "" {
+		return nil, fmt.Errorf("Route requires a method and path")
+	}
+
+	if route.Dispatch == nil && route.GraphQL == nil {
+		return route.RuleConfig.compile(wfirewall)
+	}
+
+	if route.Text != "" || len(route.Ops) != 0 {
+		return nil, fmt.Errorf("Route may either have a text or a dispatch, not both")
+	}
+
+	if route.Dispatch != nil && route.GraphQL != nil {
+		return nil, fmt.Errorf("Route may either have a dispatch or a graphql, not both")
+	}
+
+	if route.GraphQL != nil {
+		return route.GraphQL.compile(wfirewall)
+	}
+
+	return route.Dispatch.compile(wfirewall)
+}
+
+func (rule RuleConfig) compile(wfirewall *WebauthnFirewall) (HandlerFnType, error) {
+	if rule.Proxy {
+		if rule.Text != "" || len(rule.Ops) != 0 {
+			return nil, fmt.Errorf("Rule may either proxy or have an authn text, not both")
+		}
+
+		if wfirewall == nil {
+			return nil, nil
+		}
+		return wfirewall.ProxyRequest, nil
+	}
+
+	if rule.Text == "" {
+		return nil, fmt.Errorf("Rule requires an authn text")
+	}
+
+	ops := make([]dslInterface, len(rule.Ops))
+	for idx, op := range rule.Ops {
+		var err error
+		if ops[idx], err = op.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if wfirewall == nil {
+		return nil, nil
+	}
+
+	return wfirewall.Authn(rule.Text, ops...), nil
+}
+
+func (dispatch DispatchConfig) compile(wfirewall *WebauthnFirewall) (HandlerFnType, error) {
+	on, err := dispatch.On.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	cases := make(map[string]HandlerFnType, len(dispatch.Cases))
+	for value, rule := range dispatch.Cases {
+		if cases[value], err = rule.compile(wfirewall); err != nil {
+			return nil, fmt.Errorf("Dispatch case %s: %v", value, err)
+		}
+	}
+
+	var defaultFn HandlerFnType
+	if dispatch.Default != nil {
+		if defaultFn, err = dispatch.Default.compile(wfirewall); err != nil {
+			return nil, fmt.Errorf("Dispatch default: %v", err)
+		}
+	}
+
+	if wfirewall == nil {
+		return nil, nil
+	}
+
+	// Refuse all requests which no rule applies to, since a value chosen by the
+	// client, such as a near miss of a case, may not get around the assertions
+	if defaultFn == nil {
+		defaultFn = func(w http.ResponseWriter, r *ExtendedRequest) {
+			log.Warn("Denied request matching no dispatch case: %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Request matches none of the rules of the route", http.StatusForbidden)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *ExtendedRequest) {
+		// A missing input selects the default, just like an unmatched value
+		value := on.retrieve(r, make(scopeContainer))
+		if r.err != nil {
+			r.err = nil
+			value = ""
+		}
+
+		handlerFn, ok := cases[fmt.Sprintf("%v", value)]
+		if !ok {
+			handlerFn = defaultFn
+		}
+
+		// Run the `handlerFn`
+		handlerFn(w, r)
+	}, nil
+}
+
+func (graphQL GraphQLConfig) compile(wfirewall *WebauthnFirewall) (HandlerFnType, error) {
+	if len(graphQL.Mutations) == 0 {
+		return nil, fmt.Errorf("GraphQL route requires at least one mutation")
+	}
+
+	mutations := make(map[string]HandlerFnType, len(graphQL.Mutations))
+	for field, rule := range graphQL.Mutations {
+		var err error
+		if mutations[field], err = rule.compile(wfirewall); err != nil {
+			return nil, fmt.Errorf("GraphQL mutation %s: %v", field, err)
+		}
+	}
+
+	var defaultFn HandlerFnType
+	if graphQL.Default != nil {
+		var err error
+		if defaultFn, err = graphQL.Default.compile(wfirewall); err != nil {
+			return nil, fmt.Errorf("GraphQL default: %v", err)
+		}
+	}
+
+	if wfirewall == nil {
+		return nil, nil
+	}
+
+	router := wfirewall.NewGraphQLRouter()
+	for field, handleFn := range mutations {
+		router.Mutation(field, handleFn)
+	}
+
+	if defaultFn != nil {
+		router.Unmatched(defaultFn)
+	}
+
+	return router.Handle, nil
+}
+
+// The `getInput` constructors by their source, and for each of the "string", "int64" and "array" types
+var getInputConstructors = map[string][3]func(string) getInput{
+	"":          {Get, GetInt64, GetArray},
+	"form":      {Get_Form, GetInt64_Form, GetArray_Form},
+	"json":      {Get_JSON, GetInt64_JSON, GetArray_JSON},
+	"url":       {Get_URL, GetInt64_URL, GetArray_URL},
+	"url_param": {Get_URLParam, GetInt64_URLParam, GetArray_URLParam},
+	"header":    {Get_Header, GetInt64_Header, GetArray_Header},
+	"cookie":    {Get_Cookie, GetInt64_Cookie, GetArray_Cookie},
+
+	"multipart":      {Get_Multipart, GetInt64_Multipart, GetArray_Multipart},
+	"multipart_file": {Get_MultipartFile, GetInt64_MultipartFile, GetArray_MultipartFile},
+	"graphql_var":    {Get_GraphQLVar, GetInt64_GraphQLVar, GetArray_GraphQLVar},
+	"graphql_arg":    {Get_GraphQLArg, GetInt64_GraphQLArg, GetArray_GraphQLArg},
+}
+
+// Compile the `op` into its DSL operation
+func (op OpConfig) compile() (dslInterface, error) {
+	kinds := 0
+	for _, set := range []bool{op.Get != "", op.UserID, op.Var != "", op.Context != "",
+		op.SetVar != "", op.SetContext != "", op.Log != ""} {
+		if set {
+			kinds++
+		}
+	}
+
+	if kinds != 1 {
+		return nil, fmt.Errorf("Operation must be exactly one of get, user_id, var, context, set_var, set_context or log: %+v", op)
+	}
+
+	args := make([]dslInterface, len(op.Args))
+	for idx, arg := range op.Args {
+		var err error
+		if args[idx], err = arg.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case op.Get != "":
+		constructors, ok := getInputConstructors[op.Source]
+		if !ok {
+			return nil, fmt.Errorf("Unknown input source: %s", op.Source)
+		}
+
+		var get getInput
+		switch op.Type {
+		case "string", "":
+			get = constructors[0](op.Get)
+		case "int64":
+			get = constructors[1](op.Get)
+		case "array":
+			get = constructors[2](op.Get)
+		default:
+			return nil, fmt.Errorf("Unknown input type: %s", op.Type)
+		}
+
+		for _, subField := range op.SubFields {
+			get = get.SubField(subField)
+		}
+		return get, nil
+
+	case op.UserID:
+		return GetUserID(), nil
+
+	case op.Var != "":
+		get := GetVar(op.Var)
+		for _, subField := range op.SubFields {
+			get = get.SubField(subField)
+		}
+		return get, nil
+
+	case op.Context != "":
+		get := GetContext(op.Context, args...)
+		for _, subField := range op.SubFields {
+			get = get.SubField(subField)
+		}
+		return get, nil
+
+	case op.SetVar != "":
+		if op.Value == nil {
+			return nil, fmt.Errorf("set_var %s requires a value", op.SetVar)
+		}
+
+		value, err := op.Value.compile()
+		if err != nil {
+			return nil, err
+		}
+		return SetVar(op.SetVar, value), nil
+
+	case op.SetContext != "":
+		return SetContextVar(op.SetContext, args...), nil
+	}
+
+	return Log(op.Log, args...), nil
+}
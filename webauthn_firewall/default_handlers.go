@@ -1,13 +1,20 @@
 package webauthn_firewall
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
 
 	"webauthn/protocol"
+	"webauthn/webauthn"
 )
 
 // TODO!: Check some sort of token before responding to this since any user can
@@ -24,7 +31,7 @@ func (wfirewall *WebauthnFirewall) webauthnIsEnabled(w http.ResponseWriter, r *E
 	// Get the `user` variable passed in the url
 	username := r.GetURLInput("user")
 
-	isEnabled := db.WebauthnStore.IsUserEnabled(db.QueryByUsername(username))
+	isEnabled := wfirewall.store.IsUserEnabled(db.QueryByUsername(username))
 
 	// Marshal a response `webauthn_is_enabled` field
 	json_response, err := json.Marshal(map[string]bool{"webauthn_is_enabled": isEnabled})
@@ -56,18 +63,37 @@ func (wfirewall *WebauthnFirewall) beginRegister(w http.ResponseWriter, r *Exten
 		return
 	}
 
+	// The `userID` is handed to the authenticator as the user handle
+	err = db.CheckUserID(userID)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Retrieve any credentials already registered by this user
+	existingUser, err := wfirewall.store.GetWebauthnUser(db.QueryByUserID(userID))
+	if r.HandleError(w, err) {
+		return
+	}
+
 	// Create a new `webauthnUser` struct from the input details
-	wuser := db.NewWebauthnUser(userID, username, nil)
+	wuser := db.NewWebauthnUser(userID, username, existingUser.WebAuthnCredentials())
+
+	// Have the authenticator refuse to register an already registered credential. Prefer
+	// user verification so that routes requiring it can later be satisfied
+	registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
+		credCreationOpts.CredentialExcludeList = wuser.CredentialExcludeList()
+		credCreationOpts.AuthenticatorSelection.UserVerification = protocol.VerificationPreferred
 
-	// TODO
-	// registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
-	// 	credCreationOpts.CredentialExcludeList = wuser.CredentialExcludeList()
-	// }
+		// Usernameless login requires the credential to be stored on the authenticator
+		if wfirewall.passwordlessLogin != nil {
+			credCreationOpts.AuthenticatorSelection.RequireResidentKey = protocol.ResidentKeyRequired()
+		}
+	}
 
 	// generate PublicKeyCredentialCreationOptions, session data
-	options, sessionData, err := webauthnAPI.BeginRegistration(
+	options, sessionData, err := wfirewall.webauthnAPI.BeginRegistration(
 		wuser,
-		// TODO registerOptions,
+		append(wfirewall.registerAttestation.registrationOptions(), registerOptions)...,
 	)
 	if r.HandleError(w, err) {
 		return
@@ -80,7 +106,13 @@ func (wfirewall *WebauthnFirewall) beginRegister(w http.ResponseWriter, r *Exten
 	}
 
 	// Save the `sessionData` as marshaled JSON
-	err = sessionStore.SaveWebauthnSession("registration", sessionData, r.Request, w)
+	err = wfirewall.sessionStore.SaveWebauthnSession("registration", sessionData, r.Request, w)
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Track the challenge so that it can only be used once
+	err = wfirewall.issueChallenge(sessionData)
 	if r.HandleError(w, err) {
 		return
 	}
@@ -114,29 +146,75 @@ func (wfirewall *WebauthnFirewall) finishRegister(w http.ResponseWriter, r *Exte
 		return
 	}
 
-	// Create a new `webauthnUser` struct from the input details
-	wuser := db.NewWebauthnUser(userID, username, nil)
+	// Retrieve any credentials already registered by this user
+	existingUser, err := wfirewall.store.GetWebauthnUser(db.QueryByUserID(userID))
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Create a new `webauthnUser` struct from the input details. The new
+	// credential gets registered alongside of the `existingUser` credentials
+	wuser := db.NewWebauthnUser(userID, username, existingUser.WebAuthnCredentials())
 
 	// Load the session data
-	sessionData, err := sessionStore.GetWebauthnSession("registration", r.Request)
+	sessionData, err := wfirewall.sessionStore.GetWebauthnSession("registration", r.Request)
 	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
 		return
 	}
 
-	wcredential, err := webauthnAPI.FinishRegistration(wuser, sessionData, credentials)
+	// Refuse a challenge which was already used, even if its session cookie is still valid
+	err = wfirewall.consumeChallenge(sessionData)
 	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
 		return
 	}
 
+	wcredential, err := wfirewall.webauthnAPI.FinishRegistration(wuser, sessionData, credentials)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Refuse authenticators which do not comply with the attestation policy
+	err = wfirewall.registerAttestation.verify(credentials)
+	if r.HandleError_WithStatus(w, err, http.StatusForbidden) {
+		return
+	}
+
+	// Refuse to register the same authenticator more than once
+	if wfirewall.store.IsCredentialRegistered(wcredential.ID) {
+		err = fmt.Errorf("This authenticator is already registered")
+		r.HandleError_WithStatus(w, err, http.StatusConflict)
+		return
+	}
+
+	// Extract the registration details which the `wcredential` does not hold
+	metadata, err := parseCredentialMetadata(credentials)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+	metadata.RPID = wfirewall.rpID
+	metadata.Nickname = r.IgnoreError(r.Get, "nickname")
+
+	// A credential may be registered without a nickname
+	if metadata.Nickname != "" {
+		err = validateNickname(metadata.Nickname)
+		if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+			return
+		}
+	}
+
+	// Save the `wcredential` to the database
+	err = wfirewall.store.Create(wuser, wcredential, metadata)
+	if err != nil {
+		r.HandleError(w, fmt.Errorf("Failed to save the webauthn credential"))
+		return
+	}
+
 	// Marshal a response `redirectTo` field to reload the page
 	json_response, err := json.Marshal(map[string]string{"redirectTo": ""})
 	if r.HandleError(w, err) {
 		return
 	}
 
-	// Save the `wcredential` to the database
-	db.WebauthnStore.Create(wuser, wcredential)
-
 	// Success!
 	w.WriteHeader(http.StatusOK)
 	w.Write(json_response)
@@ -146,10 +224,11 @@ func (wfirewall *WebauthnFirewall) finishRegister(w http.ResponseWriter, r *Exte
 // than this `http.Error` stuff
 func (wfirewall *WebauthnFirewall) beginAttestation_base(
 	query db.WebauthnQuery, clientExtensions protocol.AuthenticationExtensions,
+	userVerification protocol.UserVerificationRequirement,
 	w http.ResponseWriter, r *ExtendedRequest) {
 
 	// See if the user has webauthn enabled
-	isEnabled := db.WebauthnStore.IsUserEnabled(query)
+	isEnabled := wfirewall.store.IsUserEnabled(query)
 
 	// Do nothing if the user does not have webauthn enabled
 	if !isEnabled {
@@ -158,7 +237,7 @@ func (wfirewall *WebauthnFirewall) beginAttestation_base(
 	}
 
 	// Get a `webauthnUser` from the input `query`
-	wuser, err := db.WebauthnStore.GetWebauthnUser(query)
+	wuser, err := wfirewall.store.GetWebauthnUser(query)
 	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
 		return
 	}
@@ -166,7 +245,7 @@ func (wfirewall *WebauthnFirewall) beginAttestation_base(
 	// TODO: The `clientExtensions` in BeginLogin is now superfluous
 	//
 	// Generate the webauthn `options` and `sessionData`
-	options, sessionData, err := webauthnAPI.BeginLogin(wuser, nil)
+	options, sessionData, err := wfirewall.webauthnAPI.BeginLogin(wuser, nil, webauthn.WithUserVerification(userVerification))
 	if r.HandleError(w, err) {
 		return
 	}
@@ -181,7 +260,13 @@ func (wfirewall *WebauthnFirewall) beginAttestation_base(
 	}
 
 	// Store session data as marshaled JSON
-	err = sessionStore.SaveWebauthnSession("authentication", sessionData, r.Request, w)
+	err = wfirewall.sessionStore.SaveWebauthnSession("authentication", sessionData, r.Request, w)
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Track the challenge so that it can only be used once
+	err = wfirewall.issueChallenge(sessionData)
 	if r.HandleError(w, err) {
 		return
 	}
@@ -210,11 +295,34 @@ func (wfirewall *WebauthnFirewall) beginAttestation(w http.ResponseWriter, r *Ex
 		return
 	}
 
+	// The frontend may ask for user verification, for routes which require it
+	userVerification := protocol.VerificationPreferred
+	if r.IgnoreError(r.Get, "user_verification") == string(protocol.VerificationRequired) {
+		userVerification = protocol.VerificationRequired
+	}
+
 	// Set the transaction authentication extension
 	extensions := make(protocol.AuthenticationExtensions)
 	extensions["txAuthSimple"] = authenticationText
 
-	wfirewall.beginAttestation_base(db.QueryByUserID(userID), extensions, w, r)
+	// For routes binding the assertion to the request, the frontend supplies the request it is
+	// about to send. The digest is computed here so that the frontend need not canonicalize it
+	if requestMethod := r.IgnoreError(r.Get, "request_method"); requestMethod != "" {
+		requestURL, err := url.Parse(r.IgnoreError(r.Get, "request_path"))
+		if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+			return
+		}
+
+		digest, err := requestDigest(requestMethod, requestURL,
+			r.IgnoreError(r.Get, "request_content_type"),
+			strings.NewReader(r.IgnoreError(r.Get, "request_body")), r.bodyMemoryLimit)
+		if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+			return
+		}
+		extensions[requestDigestExtension] = digest
+	}
+
+	wfirewall.beginAttestation_base(db.QueryByUserID(userID), extensions, userVerification, w, r)
 	return
 }
 
@@ -231,7 +339,7 @@ func (wfirewall *WebauthnFirewall) beginLogin(w http.ResponseWriter, r *Extended
 		return
 	}
 
-	wfirewall.beginAttestation_base(db.QueryByUsername(username), nil, w, r)
+	wfirewall.beginAttestation_base(db.QueryByUsername(username), nil, protocol.VerificationPreferred, w, r)
 	return
 }
 
@@ -251,7 +359,7 @@ func (wfirewall *WebauthnFirewall) finishLogin(w http.ResponseWriter, r *Extende
 	}
 
 	// See if the user has webauthn enabled
-	isEnabled := db.WebauthnStore.IsUserEnabled(db.QueryByUsername(username))
+	isEnabled := wfirewall.store.IsUserEnabled(db.QueryByUsername(username))
 
 	// Perform a webauthn check if webauthn is enabled for this user
 	if isEnabled {
@@ -271,6 +379,111 @@ func (wfirewall *WebauthnFirewall) finishLogin(w http.ResponseWriter, r *Extende
 	return
 }
 
+func (wfirewall *WebauthnFirewall) beginPasswordlessLogin(w http.ResponseWriter, r *ExtendedRequest) {
+	// Call the firewall preamble
+	wfirewall.preamble(w, r)
+
+	// Prepare the response for a JSON object return
+	wfirewall.prepareJSONResponse(w)
+
+	challenge, err := protocol.CreateChallenge()
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Leave the allowed credentials empty so that the authenticator offers
+	// its discoverable credentials. The user is only known once it responds
+	requestOptions := protocol.PublicKeyCredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          wfirewall.webauthnAPI.Config.Timeout,
+		RelyingPartyID:   wfirewall.webauthnAPI.Config.RPID,
+		UserVerification: protocol.VerificationRequired,
+	}
+
+	sessionData := webauthn.SessionData{
+		Challenge:        base64.RawURLEncoding.EncodeToString(challenge),
+		UserVerification: requestOptions.UserVerification,
+	}
+
+	// Convert the `requestOptions` into JSON format
+	json_response, err := json.Marshal(requestOptions)
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Store session data as marshaled JSON
+	err = wfirewall.sessionStore.SaveWebauthnSession("authentication", &sessionData, r.Request, w)
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Track the challenge so that it can only be used once
+	err = wfirewall.issueChallenge(&sessionData)
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Return the `json_response`
+	w.WriteHeader(http.StatusOK)
+	w.Write(json_response)
+}
+
+func (wfirewall *WebauthnFirewall) finishPasswordlessLogin(w http.ResponseWriter, r *ExtendedRequest) {
+	// Call the firewall preamble
+	wfirewall.preamble(w, r)
+
+	// Parse the form-data to retrieve the `http.Request` information
+	assertion, err := r.Get_WithErr("assertion")
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Resolve the user from the user handle returned by the authenticator
+	parsed, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(assertion))
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	userID, err := db.UserIDFromWebAuthnID(parsed.Response.UserHandle)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	query := db.QueryByUserID(userID)
+	wuser, err := wfirewall.store.GetWebauthnUser(query)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	if len(wuser.WebAuthnCredentials()) == 0 {
+		r.HandleError_WithStatus(w, fmt.Errorf("Unknown webauthn user handle"), http.StatusBadRequest)
+		return
+	}
+
+	// Load the session data
+	sessionData, err := wfirewall.sessionStore.GetWebauthnSession("authentication", r.Request)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Bind the ceremony to the resolved user. The user handle
+	// is checked against the `wuser` during verification
+	sessionData.UserID = wuser.WebAuthnID()
+
+	// A passwordless login must always verify the user. There are no extensions to verify
+	r.requireUserVerification = true
+	err = wfirewall.verifyAssertion(r, query, sessionData, nil, assertion)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Have the backend create the session for the `userID`
+	err = wfirewall.passwordlessLogin(w, r, userID)
+	if r.HandleError(w, err) {
+		return
+	}
+}
+
 func (wfirewall *WebauthnFirewall) disableWebauthn(w http.ResponseWriter, r *ExtendedRequest) {
 	// Call the firewall preamble
 	wfirewall.preamble(w, r)
@@ -294,7 +507,7 @@ func (wfirewall *WebauthnFirewall) disableWebauthn(w http.ResponseWriter, r *Ext
 	query := db.QueryByUserID(userID)
 
 	// Get a `webauthnUser` for the `query`
-	wuser, err := db.WebauthnStore.GetWebauthnUser(query)
+	wuser, err := wfirewall.store.GetWebauthnUser(query)
 	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
 		return
 	}
@@ -316,7 +529,221 @@ func (wfirewall *WebauthnFirewall) disableWebauthn(w http.ResponseWriter, r *Ext
 	}
 
 	// Save the `credential` to the database
-	db.WebauthnStore.Delete(wuser.WebAuthnName())
+	wfirewall.store.Delete(wuser.WebAuthnName())
+
+	// Success!
+	w.WriteHeader(http.StatusOK)
+	w.Write(json_response)
+}
+
+// The metadata of a single credential returned by `listCredentials`
+type credentialInfo struct {
+	ID              string     `json:"id"`
+	Nickname        string     `json:"nickname"`
+	Created         time.Time  `json:"created"`
+	LastUsed        *time.Time `json:"last_used"`
+	AAGUID          string     `json:"aaguid"`
+	AttestationType string     `json:"attestation_type"`
+	Transports      []string   `json:"transports"`
+	BackupEligible  bool       `json:"backup_eligible"`
+}
+
+func (wfirewall *WebauthnFirewall) listCredentials(w http.ResponseWriter, r *ExtendedRequest) {
+	// Call the firewall preamble
+	wfirewall.preamble(w, r)
+
+	// Prepare the response for a JSON object return
+	wfirewall.prepareJSONResponse(w)
+
+	// Retrieve the `userID` associated with the current request
+	userID, err := r.GetUserID()
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Get all of the credentials registered by the user
+	entries, err := wfirewall.store.GetCredentials(db.QueryByUserID(userID))
+	if r.HandleError(w, err) {
+		return
+	}
+
+	credentials := make([]credentialInfo, len(entries))
+	for idx, entry := range entries {
+		credentials[idx] = credentialInfo{
+			ID:       base64.RawURLEncoding.EncodeToString(entry.CredID),
+			Nickname: entry.Nickname,
+			Created:  entry.Created,
+			AAGUID:   formatAAGUID(entry.AAGUID),
+
+			AttestationType: entry.AttestationType,
+			Transports:      entry.TransportList(),
+			BackupEligible:  entry.BackupEligible,
+		}
+
+		// Only include the `LastUsed` time if the credential was ever used
+		if entry.LastUsedUnix != 0 {
+			lastUsed := entry.LastUsed
+			credentials[idx].LastUsed = &lastUsed
+		}
+	}
+
+	// Marshal a response `credentials` field
+	json_response, err := json.Marshal(map[string][]credentialInfo{"credentials": credentials})
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Return the `json_response`
+	w.WriteHeader(http.StatusOK)
+	w.Write(json_response)
+}
+
+func (wfirewall *WebauthnFirewall) renameCredential(w http.ResponseWriter, r *ExtendedRequest) {
+	// Call the firewall preamble
+	wfirewall.preamble(w, r)
+
+	// Prepare the response for a JSON object return
+	wfirewall.prepareJSONResponse(w)
+
+	// Retrieve the `userID` associated with the current request
+	userID, err := r.GetUserID()
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Parse the form-data to retrieve the `http.Request` information
+	credID, err := r.Get_WithErr("cred_id")
+	if r.HandleError(w, err) {
+		return
+	}
+
+	nickname, err := r.Get_WithErr("nickname")
+	if r.HandleError(w, err) {
+		return
+	}
+
+	err = validateNickname(nickname)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	rawCredID, err := base64.RawURLEncoding.DecodeString(credID)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Rename the credential, only if it belongs to the `userID`
+	err = wfirewall.store.RenameCredential(db.QueryByCredID(userID, rawCredID), nickname)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Marshal a response `redirectTo` field to reload the page
+	json_response, err := json.Marshal(map[string]string{"redirectTo": ""})
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Success!
+	w.WriteHeader(http.StatusOK)
+	w.Write(json_response)
+}
+
+// The longest nickname in bytes, which is the size of its database column
+const maxNicknameLength = 64
+
+// Check that the `nickname` fits its database column and holds no control characters
+func validateNickname(nickname string) error {
+	if strings.TrimSpace(nickname) == "" {
+		return fmt.Errorf("Credential nickname may not be empty")
+	}
+
+	if len(nickname) > maxNicknameLength {
+		return fmt.Errorf("Credential nickname longer than %d bytes", maxNicknameLength)
+	}
+
+	if !utf8.ValidString(nickname) {
+		return fmt.Errorf("Credential nickname is not valid UTF-8")
+	}
+
+	for _, c := range nickname {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("Credential nickname may not hold control characters")
+		}
+	}
+
+	return nil
+}
+
+func (wfirewall *WebauthnFirewall) revokeCredential(w http.ResponseWriter, r *ExtendedRequest) {
+	// Call the firewall preamble
+	wfirewall.preamble(w, r)
+
+	// Prepare the response for a JSON object return
+	wfirewall.prepareJSONResponse(w)
+
+	// Retrieve the `userID` associated with the current request
+	userID, err := r.GetUserID()
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Parse the form-data to retrieve the `http.Request` information
+	credID, err := r.Get_WithErr("cred_id")
+	if r.HandleError(w, err) {
+		return
+	}
+
+	assertion, err := r.Get_WithErr("assertion")
+	if r.HandleError(w, err) {
+		return
+	}
+
+	rawCredID, err := base64.RawURLEncoding.DecodeString(credID)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Make sure that the credential to revoke belongs to the `userID`
+	credQuery := db.QueryByCredID(userID, rawCredID)
+	entries, err := wfirewall.store.GetCredentials(credQuery)
+	if r.HandleError(w, err) {
+		return
+	}
+
+	if len(entries) == 0 {
+		r.HandleError_WithStatus(w, fmt.Errorf("Webauthn credential not found"), http.StatusBadRequest)
+		return
+	}
+
+	// Refer to the credential by its nickname if it has one
+	credName := entries[0].Nickname
+	if credName == "" {
+		credName = credID
+	}
+
+	// Create the extension to verify against
+	extensions := make(protocol.AuthenticationExtensions)
+	extensions["txAuthSimple"] = fmt.Sprintf("Confirm revoke webauthn credential %v for %v", credName, entries[0].Username)
+
+	// Check the webauthn assertion for this operation. Any of the
+	// user's credentials may sign off on the revoke
+	err = CheckWebauthnAssertion(r, db.QueryByUserID(userID), extensions, assertion)
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Remove the single credential from the database
+	err = wfirewall.store.DeleteCredentials(credQuery)
+	if r.HandleError(w, err) {
+		return
+	}
+
+	// Marshal a response `redirectTo` field to reload the page
+	json_response, err := json.Marshal(map[string]string{"redirectTo": ""})
+	if r.HandleError(w, err) {
+		return
+	}
 
 	// Success!
 	w.WriteHeader(http.StatusOK)
@@ -194,19 +194,185 @@ func GetArray_URLParam(field string) getInput {
 	}
 }
 
+func Get_Header(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetHeader_WithErr(args...)
+		},
+	}
+}
+
+func GetInt64_Header(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetHeaderInt64_WithErr(args...)
+		},
+	}
+}
+
+func GetArray_Header(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetHeaderArray_WithErr(args...)
+		},
+	}
+}
+
+func Get_Cookie(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetCookie_WithErr(args...)
+		},
+	}
+}
+
+func GetInt64_Cookie(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetCookieInt64_WithErr(args...)
+		},
+	}
+}
+
+func GetArray_Cookie(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetCookieArray_WithErr(args...)
+		},
+	}
+}
+
+func Get_Multipart(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetMultipartInput_WithErr(args...)
+		},
+	}
+}
+
+func GetInt64_Multipart(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetMultipartInputInt64_WithErr(args...)
+		},
+	}
+}
+
+func GetArray_Multipart(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetMultipartInputArray_WithErr(args...)
+		},
+	}
+}
+
+// Describe the files uploaded in `field`. Select a single attribute
+// with `SubField`, i.e. `Get_MultipartFile("files").SubField(FileAttrSHA256)`
+func Get_MultipartFile(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetMultipartFile_WithErr(args...)
+		},
+	}
+}
+
+func GetInt64_MultipartFile(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetMultipartFileInt64_WithErr(args...)
+		},
+	}
+}
+
+func GetArray_MultipartFile(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetMultipartFileArray_WithErr(args...)
+		},
+	}
+}
+
+// Read the GraphQL variable `field`. Descend into its value with `SubField`
+func Get_GraphQLVar(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetGraphQLVar_WithErr(args...)
+		},
+	}
+}
+
+func GetInt64_GraphQLVar(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetGraphQLVarInt64_WithErr(args...)
+		},
+	}
+}
+
+func GetArray_GraphQLVar(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetGraphQLVarArray_WithErr(args...)
+		},
+	}
+}
+
+// Read the argument `field` of the GraphQL mutation the request was dispatched on
+func Get_GraphQLArg(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetGraphQLArg_WithErr(args...)
+		},
+	}
+}
+
+func GetInt64_GraphQLArg(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetGraphQLArgInt64_WithErr(args...)
+		},
+	}
+}
+
+func GetArray_GraphQLArg(field string) getInput {
+	return getInput{
+		fields: []string{field},
+		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
+			return r.GetGraphQLArgArray_WithErr(args...)
+		},
+	}
+}
+
 func GetUserID() getInput {
 	return getInput{
 		fields: []string{},
 		getInputFn: func(r *ExtendedRequest, args ...string) (interface{}, error) {
 			// Sanity check the input
 			if len(args) != 0 {
-				return 0, fmt.Errorf("GetUserID should get no arguments")
+				return "", fmt.Errorf("GetUserID should get no arguments")
 			}
 
-			// Get the userID and convert it to a `string`
+			// Get the opaque userID `string`
 			val, err := r.GetUserID()
 			if err != nil {
-				return 0, err
+				return "", err
 			}
 
 			// Success!
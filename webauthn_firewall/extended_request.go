@@ -1,10 +1,12 @@
 package webauthn_firewall
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 
 	log "unknwon.dev/clog/v2"
 )
@@ -16,34 +18,173 @@ type RequestRefiller struct {
 
 type ExtendedRequest struct {
 	*http.Request
-	data []byte
 
-	GetUserID       func() (int64, error)
+	// The body is only buffered once it is inspected, otherwise it streams to the backend
+	body            *requestBody
+	maxBodySize     int64
+	bodyMemoryLimit int64
+
+	// The body is parsed on first use, and then shared by every getter of the request
+	jsonParsed bool
+	jsonValue  interface{}
+	jsonErr    error
+	formParsed bool
+	formErr    error
+	// The SHA-256 digests of the uploaded files, computed on first use
+	fileDigests map[*multipart.FileHeader]string
+	// The GraphQL operation of the request, parsed on first use
+	graphQLParsed bool
+	graphQLValue  *GraphQLRequest
+	graphQLErr    error
+	// The root field which a `GraphQLRouter` dispatched the request on
+	graphQLField *GraphQLField
+
+	// The firewall which routed the request
+	firewall *WebauthnFirewall
+
+	GetUserID       func() (string, error)
 	getInputDefault getInputFnType
 	contextGetters  ContextGettersType
 
+	// Set for routes secured with `RequireUserVerification`
+	requireUserVerification bool
+	// Set for routes secured with `BindRequestBody`
+	bindRequestBody bool
+
 	err error
 }
 
-func (er *ExtendedRequest) initRefillData() {
-	// Get the `data` from the `http.Request` so that it can be restored again if necessary
-	data, err := ioutil.ReadAll(er.Request.Body)
+func (er *ExtendedRequest) Firewall() *WebauthnFirewall {
+	return er.firewall
+}
+
+// Buffer the body of the `http.Request` so that it can be inspected and restored again. This is
+// only done on the first call, by the functions which inspect the body
+func (er *ExtendedRequest) initRefillData() error {
+	if er.body != nil {
+		return nil
+	}
+
+	body, err := bufferBody(er.Request.Body, er.maxBodySize, er.bodyMemoryLimit)
 	if err != nil {
-		// Set the current `er.err`
-		er.err = err
-		return
+		return err
 	}
+	er.Request.Body.Close()
 
-	// Set `data` field
-	er.data = data
+	// Set `body` field
+	er.body = body
 
 	// Refill the `http.Request` since it was read during setup
 	er.Refill()
+	return nil
 }
 
 func (er *ExtendedRequest) Refill() {
-	// Reload the `r.Body` from the `data` before reading the form fields
-	er.Request.Body = ioutil.NopCloser(bytes.NewReader(er.data))
+	// A body which was never buffered was also never read
+	if er.body == nil {
+		return
+	}
+
+	// Reload the `r.Body` from the `body` before reading the form fields
+	er.Request.Body = er.body.reader()
+}
+
+// A reader over the entire buffered body of the request, which streams a spilled body from disk
+func (er *ExtendedRequest) bodyReader() (io.Reader, error) {
+	if err := er.initRefillData(); err != nil {
+		return nil, err
+	}
+
+	return er.body.reader(), nil
+}
+
+// The entire buffered body of the request in memory. Bodies larger than the memory limit are
+// refused, so only inspect bodies this way which have to be held in memory as a whole
+func (er *ExtendedRequest) bodyBytes() ([]byte, error) {
+	if err := er.initRefillData(); err != nil {
+		return nil, err
+	}
+
+	return er.body.bytes()
+}
+
+// The JSON body of the request, decoded once with its numbers as `json.Number`
+func (er *ExtendedRequest) parsedJSON() (interface{}, error) {
+	if er.jsonParsed {
+		return er.jsonValue, er.jsonErr
+	}
+	er.jsonParsed = true
+
+	body, err := er.bodyReader()
+	if err != nil {
+		er.jsonErr = err
+		return nil, err
+	}
+
+	// Unmarshal numbers into the `Number` type
+	var value interface{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+
+	er.jsonErr = dec.Decode(&value)
+	er.jsonValue = value
+	return er.jsonValue, er.jsonErr
+}
+
+// The GraphQL operation of the request, parsed once
+func (er *ExtendedRequest) GraphQL() (*GraphQLRequest, error) {
+	if er.graphQLParsed {
+		return er.graphQLValue, er.graphQLErr
+	}
+	er.graphQLParsed = true
+
+	// The operation of a GET request is entirely in its URL. Any other is parsed in
+	// memory, so its body may not be larger than the memory limit
+	var body []byte
+	if er.Request.Method != "GET" {
+		body, er.graphQLErr = er.bodyBytes()
+		if er.graphQLErr != nil {
+			return nil, er.graphQLErr
+		}
+	}
+
+	er.graphQLValue, er.graphQLErr = ParseGraphQLRequest(er.Request, body)
+	return er.graphQLValue, er.graphQLErr
+}
+
+// The form values of the request, from both the URL query and the body, parsed once
+func (er *ExtendedRequest) parsedForm() (url.Values, error) {
+	if er.formParsed {
+		return er.Request.Form, er.formErr
+	}
+	er.formParsed = true
+
+	// Buffer the body, since parsing the form reads it
+	if er.formErr = er.initRefillData(); er.formErr != nil {
+		return nil, er.formErr
+	}
+
+	// Multipart files beyond the memory limit are kept in temporary files
+	err := er.Request.ParseMultipartForm(er.bodyMemoryLimit)
+	if err != nil && err != http.ErrNotMultipart {
+		er.formErr = err
+	}
+
+	// Refill since the request is proxied onward with its `Body`
+	er.Refill()
+
+	return er.Request.Form, er.formErr
+}
+
+// Release the buffered body once the request was handled
+func (er *ExtendedRequest) closeBody() {
+	if er.body != nil {
+		er.body.close()
+	}
+
+	if er.Request != nil && er.Request.MultipartForm != nil {
+		er.Request.MultipartForm.RemoveAll()
+	}
 }
 
 func (er *ExtendedRequest) IgnoreError(getter func(...string) string, args ...string) string {
@@ -98,6 +239,11 @@ func (er *ExtendedRequest) HandleAnyErrors(w http.ResponseWriter) bool {
 }
 
 func (er *ExtendedRequest) HandleAnyErrors_WithStatus(w http.ResponseWriter, status int) bool {
+	// The body being too large is the fault of the client, whatever the handler expected
+	if _, ok := er.err.(bodyTooLargeError); ok {
+		status = http.StatusRequestEntityTooLarge
+	}
+
 	if er.err != nil {
 		log.Error("%v", er.err)
 		http.Error(w, er.err.Error(), status)
@@ -108,45 +254,53 @@ func (er *ExtendedRequest) HandleAnyErrors_WithStatus(w http.ResponseWriter, sta
 	return false
 }
 
-func (wfirewall *WebauthnFirewall) newExtendedRequest(r *http.Request) *ExtendedRequest {
+func (wfirewall *WebauthnFirewall) newExtendedRequest(r *http.Request, contextGetters ContextGettersType) *ExtendedRequest {
 	// Extract the `getInputDefault` function for the request's host
 	host := r.Host
 	target, ok := wfirewall.ReverseProxyTargetMap[host]
 	if !ok {
 		return &ExtendedRequest{
-			err: fmt.Errorf("Host %s not found in proxy target map: %v", host, wfirewall.ReverseProxyTargetMap),
+			firewall: wfirewall,
+			err:      fmt.Errorf("Host %s not found in proxy target map: %v", host, wfirewall.ReverseProxyTargetMap),
 		}
 	}
 
 	extendedReq := &ExtendedRequest{
-		Request: r,
+		Request:  r,
+		firewall: wfirewall,
 
 		// Set the useful helper functions
-		GetUserID: func() (int64, error) {
+		GetUserID: func() (string, error) {
 			return wfirewall.getUserID(r)
 		},
 		getInputDefault: target.getInputDefault,
-		contextGetters:  wfirewall.contextGetters,
+		contextGetters:  contextGetters,
+
+		maxBodySize:     wfirewall.maxBodySize,
+		bodyMemoryLimit: wfirewall.bodyMemoryLimit,
 
 		err: nil,
 	}
 
-	// Initialize the refill data
-	extendedReq.initRefillData()
-
 	return extendedReq
 }
 
 func (wfirewall *WebauthnFirewall) wrapWithExtendedReq(handleFn HandlerFnType) func(w http.ResponseWriter, r *http.Request) {
+	// Routes keep the context getters they were registered with, even across reloads
+	contextGetters := wfirewall.contextGetters
+
 	// Wrap the `handleFn` with a function that initializes a `ExtendedRequest`
 	wrappedFn := func(w http.ResponseWriter, r *http.Request) {
-		extendedReq := wfirewall.newExtendedRequest(r)
+		extendedReq := wfirewall.newExtendedRequest(r, contextGetters)
 
 		// Exit on any errors during `extendedReq` creation
 		if extendedReq.HandleAnyErrors(w) {
 			return
 		}
 
+		// Remove any body spilled to disk once the request was handled
+		defer extendedReq.closeBody()
+
 		handleFn(w, extendedReq)
 	}
 
@@ -1,8 +1,13 @@
 package webauthn_firewall
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
@@ -25,8 +30,14 @@ func GetFormInput(r *ExtendedRequest, args ...string) (interface{}, error) {
 		return "", err
 	}
 
+	// Parse the form on first use
+	form, err := r.parsedForm()
+	if err != nil {
+		return "", err
+	}
+
 	// Retrieve the respective form value
-	val := r.Request.FormValue(args[0])
+	val := form.Get(args[0])
 	if val == "" {
 		err := fmt.Errorf("Invalid form-data parameters")
 		return "", err
@@ -69,14 +80,8 @@ func GetJSONInput(r *ExtendedRequest, args ...string) (interface{}, error) {
 		return "", err
 	}
 
-	var body interface{}
-	body = make(jsonBody)
-
-	// Unmarshal numbers into the `Number` type
-	dec := json.NewDecoder(r.Request.Body)
-	dec.UseNumber()
-
-	err := dec.Decode(&body)
+	// Decode the body on first use
+	body, err := r.parsedJSON()
 	if err != nil {
 		return "", err
 	}
@@ -91,9 +96,6 @@ func GetJSONInput(r *ExtendedRequest, args ...string) (interface{}, error) {
 		body = cast[arg]
 	}
 
-	// Refill since future commands may need the request `Body`
-	r.Refill()
-
 	// Success!
 	return body, nil
 }
@@ -125,6 +127,249 @@ func GetURLParamInput(r *ExtendedRequest, args ...string) (interface{}, error) {
 	return urlParameter(param), nil
 }
 
+func GetHeaderInput(r *ExtendedRequest, args ...string) (interface{}, error) {
+	// Sanity check the input
+	if r == nil {
+		err := fmt.Errorf("Nil request received")
+		return "", err
+	}
+
+	// Header inputs should only have a single argument
+	if len(args) != 1 {
+		err := fmt.Errorf("Header inputs expect only 1 argument. Received: %v", args)
+		return "", err
+	}
+
+	// Find the `args[0]` among the request headers, which may be repeated
+	header, ok := r.Request.Header[http.CanonicalHeaderKey(args[0])]
+	if !ok {
+		err := fmt.Errorf("Header named %s not found among request headers", args[0])
+		return "", err
+	}
+
+	// Success!
+	return urlParameter(header), nil
+}
+
+func GetCookieInput(r *ExtendedRequest, args ...string) (interface{}, error) {
+	// Sanity check the input
+	if r == nil {
+		err := fmt.Errorf("Nil request received")
+		return "", err
+	}
+
+	// Cookie inputs should only have a single argument
+	if len(args) != 1 {
+		err := fmt.Errorf("Cookie inputs expect only 1 argument. Received: %v", args)
+		return "", err
+	}
+
+	// Collect every cookie named `args[0]`, since a client may send several
+	var values urlParameter
+	for _, cookie := range r.Request.Cookies() {
+		if cookie.Name == args[0] {
+			values = append(values, cookie.Value)
+		}
+	}
+
+	if len(values) == 0 {
+		err := fmt.Errorf("Cookie named %s not found among request cookies", args[0])
+		return "", err
+	}
+
+	// Success!
+	return values, nil
+}
+
+// Retrieve every value of a form field, which may be repeated. The values cast like URL parameters,
+// so a string requires exactly one value. Reads multipart/form-data as well as urlencoded forms
+func GetMultipartInput(r *ExtendedRequest, args ...string) (interface{}, error) {
+	// Sanity check the input
+	if r == nil {
+		err := fmt.Errorf("Nil request received")
+		return "", err
+	}
+
+	// Form fields should only have a single argument
+	if len(args) != 1 {
+		err := fmt.Errorf("Multipart inputs expect only 1 argument. Received: %v", args)
+		return "", err
+	}
+
+	// Parse the form on first use
+	form, err := r.parsedForm()
+	if err != nil {
+		return "", err
+	}
+
+	// A field which is absent has no values
+	return urlParameter(form[args[0]]), nil
+}
+
+// The attributes of an uploaded file which `GetMultipartFileInput` can retrieve
+const (
+	FileAttrFilename    = "filename"
+	FileAttrSize        = "size"
+	FileAttrContentType = "content_type"
+	FileAttrSHA256      = "sha256"
+)
+
+// Retrieve the metadata of every file uploaded in a multipart/form-data field. The first
+// argument is the field name. The optional second one selects a `FileAttr*` attribute,
+// otherwise a file is described by its name, size and SHA-256 digest. The results cast
+// like URL parameters, so a string requires exactly one file
+func GetMultipartFileInput(r *ExtendedRequest, args ...string) (interface{}, error) {
+	// Sanity check the input
+	if r == nil {
+		err := fmt.Errorf("Nil request received")
+		return "", err
+	}
+
+	// Multipart files take the field name, and optionally an attribute
+	if len(args) != 1 && len(args) != 2 {
+		err := fmt.Errorf("Multipart file inputs expect 1 or 2 arguments. Received: %v", args)
+		return "", err
+	}
+
+	// Parse the form on first use
+	if _, err := r.parsedForm(); err != nil {
+		return "", err
+	}
+
+	if r.Request.MultipartForm == nil {
+		err := fmt.Errorf("Request body is not multipart/form-data")
+		return "", err
+	}
+
+	files := r.Request.MultipartForm.File[args[0]]
+	vals := make(urlParameter, len(files))
+	for idx, file := range files {
+		attribute := ""
+		if len(args) == 2 {
+			attribute = args[1]
+		}
+
+		val, err := r.fileAttribute(file, attribute)
+		if err != nil {
+			return "", err
+		}
+		vals[idx] = val
+	}
+
+	// Success!
+	return vals, nil
+}
+
+// Retrieve the `attribute` of the uploaded `file`, or its description when `attribute` is empty
+func (r *ExtendedRequest) fileAttribute(file *multipart.FileHeader, attribute string) (string, error) {
+	switch attribute {
+	case FileAttrFilename:
+		return file.Filename, nil
+	case FileAttrSize:
+		return strconv.FormatInt(file.Size, 10), nil
+	case FileAttrContentType:
+		return file.Header.Get("Content-Type"), nil
+	case FileAttrSHA256:
+		return r.fileDigest(file)
+	case "":
+		digest, err := r.fileDigest(file)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (%d bytes, SHA-256 %s)", file.Filename, file.Size, digest), nil
+	}
+
+	return "", fmt.Errorf("Unknown multipart file attribute: %s", attribute)
+}
+
+// The hex SHA-256 digest of the uploaded `file`, computed once per request
+func (r *ExtendedRequest) fileDigest(file *multipart.FileHeader) (string, error) {
+	if digest, ok := r.fileDigests[file]; ok {
+		return digest, nil
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+
+	if r.fileDigests == nil {
+		r.fileDigests = make(map[*multipart.FileHeader]string)
+	}
+	r.fileDigests[file] = hex.EncodeToString(hash.Sum(nil))
+
+	return r.fileDigests[file], nil
+}
+
+// Retrieve a variable of the GraphQL operation of the request. The first argument is the variable
+// name, and any further ones descend into its value like the arguments of `GetJSONInput`
+func GetGraphQLVarInput(r *ExtendedRequest, args ...string) (interface{}, error) {
+	// Sanity check the input
+	if r == nil {
+		err := fmt.Errorf("Nil request received")
+		return "", err
+	}
+
+	// GraphQL variables should have at least one argument
+	if len(args) < 1 {
+		err := fmt.Errorf("GraphQL variable inputs expect at least 1 argument. Received: %v", args)
+		return "", err
+	}
+
+	// Parse the operation on first use
+	operation, err := r.GraphQL()
+	if err != nil {
+		return "", err
+	}
+
+	return descendGraphQLValue(jsonBody(operation.Variables), args)
+}
+
+// Retrieve an argument of the root field which a `GraphQLRouter` dispatched the request on. The
+// arguments take the variables they refer to, so unlike `GetGraphQLVarInput` this also sees the
+// values written into the query itself. Any further arguments descend into the value
+func GetGraphQLArgInput(r *ExtendedRequest, args ...string) (interface{}, error) {
+	// Sanity check the input
+	if r == nil {
+		err := fmt.Errorf("Nil request received")
+		return "", err
+	}
+
+	// GraphQL arguments should have at least one argument
+	if len(args) < 1 {
+		err := fmt.Errorf("GraphQL argument inputs expect at least 1 argument. Received: %v", args)
+		return "", err
+	}
+
+	if r.graphQLField == nil {
+		err := fmt.Errorf("Request was not dispatched on a GraphQL field")
+		return "", err
+	}
+
+	return descendGraphQLValue(jsonBody(r.graphQLField.Arguments), args)
+}
+
+// Descend into the GraphQL `value` along the object keys `args`
+func descendGraphQLValue(value interface{}, args []string) (interface{}, error) {
+	for _, arg := range args {
+		cast, ok := value.(jsonBody)
+		if !ok {
+			err := fmt.Errorf("GraphQL parse fail. Unable to cast intermediate to jsonBody: %[1]T %[1]v", value)
+			return "", err
+		}
+		value = cast[arg]
+	}
+
+	// Success!
+	return value, nil
+}
+
 func castToString(val interface{}) (ret string, err error) {
 	switch val.(type) {
 	case string:
@@ -392,6 +637,192 @@ func (r *ExtendedRequest) GetURLParamArray(args ...string) []interface{} {
 	return val
 }
 
+//
+// Header Get functions
+//
+
+func (r *ExtendedRequest) GetHeader_WithErr(args ...string) (string, error) {
+	return r.getInputString_WithErr_Helper(GetHeaderInput, args...)
+}
+
+func (r *ExtendedRequest) GetHeader(args ...string) string {
+	val, _ := r.getInputString_WithErr_Helper(GetHeaderInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetHeaderInt64_WithErr(args ...string) (int64, error) {
+	return r.getInputInt64_WithErr_Helper(GetHeaderInput, args...)
+}
+
+func (r *ExtendedRequest) GetHeaderInt64(args ...string) int64 {
+	val, _ := r.getInputInt64_WithErr_Helper(GetHeaderInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetHeaderArray_WithErr(args ...string) ([]interface{}, error) {
+	return r.getInputArray_WithErr_Helper(GetHeaderInput, args...)
+}
+
+func (r *ExtendedRequest) GetHeaderArray(args ...string) []interface{} {
+	val, _ := r.getInputArray_WithErr_Helper(GetHeaderInput, args...)
+	return val
+}
+
+//
+// Cookie Get functions
+//
+
+func (r *ExtendedRequest) GetCookie_WithErr(args ...string) (string, error) {
+	return r.getInputString_WithErr_Helper(GetCookieInput, args...)
+}
+
+func (r *ExtendedRequest) GetCookie(args ...string) string {
+	val, _ := r.getInputString_WithErr_Helper(GetCookieInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetCookieInt64_WithErr(args ...string) (int64, error) {
+	return r.getInputInt64_WithErr_Helper(GetCookieInput, args...)
+}
+
+func (r *ExtendedRequest) GetCookieInt64(args ...string) int64 {
+	val, _ := r.getInputInt64_WithErr_Helper(GetCookieInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetCookieArray_WithErr(args ...string) ([]interface{}, error) {
+	return r.getInputArray_WithErr_Helper(GetCookieInput, args...)
+}
+
+func (r *ExtendedRequest) GetCookieArray(args ...string) []interface{} {
+	val, _ := r.getInputArray_WithErr_Helper(GetCookieInput, args...)
+	return val
+}
+
+//
+// Multipart form Get functions
+//
+
+func (r *ExtendedRequest) GetMultipartInput_WithErr(args ...string) (string, error) {
+	return r.getInputString_WithErr_Helper(GetMultipartInput, args...)
+}
+
+func (r *ExtendedRequest) GetMultipartInput(args ...string) string {
+	val, _ := r.getInputString_WithErr_Helper(GetMultipartInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetMultipartInputInt64_WithErr(args ...string) (int64, error) {
+	return r.getInputInt64_WithErr_Helper(GetMultipartInput, args...)
+}
+
+func (r *ExtendedRequest) GetMultipartInputInt64(args ...string) int64 {
+	val, _ := r.getInputInt64_WithErr_Helper(GetMultipartInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetMultipartInputArray_WithErr(args ...string) ([]interface{}, error) {
+	return r.getInputArray_WithErr_Helper(GetMultipartInput, args...)
+}
+
+func (r *ExtendedRequest) GetMultipartInputArray(args ...string) []interface{} {
+	val, _ := r.getInputArray_WithErr_Helper(GetMultipartInput, args...)
+	return val
+}
+
+//
+// Multipart file Get functions
+//
+
+func (r *ExtendedRequest) GetMultipartFile_WithErr(args ...string) (string, error) {
+	return r.getInputString_WithErr_Helper(GetMultipartFileInput, args...)
+}
+
+func (r *ExtendedRequest) GetMultipartFile(args ...string) string {
+	val, _ := r.getInputString_WithErr_Helper(GetMultipartFileInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetMultipartFileInt64_WithErr(args ...string) (int64, error) {
+	return r.getInputInt64_WithErr_Helper(GetMultipartFileInput, args...)
+}
+
+func (r *ExtendedRequest) GetMultipartFileInt64(args ...string) int64 {
+	val, _ := r.getInputInt64_WithErr_Helper(GetMultipartFileInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetMultipartFileArray_WithErr(args ...string) ([]interface{}, error) {
+	return r.getInputArray_WithErr_Helper(GetMultipartFileInput, args...)
+}
+
+func (r *ExtendedRequest) GetMultipartFileArray(args ...string) []interface{} {
+	val, _ := r.getInputArray_WithErr_Helper(GetMultipartFileInput, args...)
+	return val
+}
+
+//
+// GraphQL variable Get functions
+//
+
+func (r *ExtendedRequest) GetGraphQLVar_WithErr(args ...string) (string, error) {
+	return r.getInputString_WithErr_Helper(GetGraphQLVarInput, args...)
+}
+
+func (r *ExtendedRequest) GetGraphQLVar(args ...string) string {
+	val, _ := r.getInputString_WithErr_Helper(GetGraphQLVarInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetGraphQLVarInt64_WithErr(args ...string) (int64, error) {
+	return r.getInputInt64_WithErr_Helper(GetGraphQLVarInput, args...)
+}
+
+func (r *ExtendedRequest) GetGraphQLVarInt64(args ...string) int64 {
+	val, _ := r.getInputInt64_WithErr_Helper(GetGraphQLVarInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetGraphQLVarArray_WithErr(args ...string) ([]interface{}, error) {
+	return r.getInputArray_WithErr_Helper(GetGraphQLVarInput, args...)
+}
+
+func (r *ExtendedRequest) GetGraphQLVarArray(args ...string) []interface{} {
+	val, _ := r.getInputArray_WithErr_Helper(GetGraphQLVarInput, args...)
+	return val
+}
+
+//
+// GraphQL argument Get functions
+//
+
+func (r *ExtendedRequest) GetGraphQLArg_WithErr(args ...string) (string, error) {
+	return r.getInputString_WithErr_Helper(GetGraphQLArgInput, args...)
+}
+
+func (r *ExtendedRequest) GetGraphQLArg(args ...string) string {
+	val, _ := r.getInputString_WithErr_Helper(GetGraphQLArgInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetGraphQLArgInt64_WithErr(args ...string) (int64, error) {
+	return r.getInputInt64_WithErr_Helper(GetGraphQLArgInput, args...)
+}
+
+func (r *ExtendedRequest) GetGraphQLArgInt64(args ...string) int64 {
+	val, _ := r.getInputInt64_WithErr_Helper(GetGraphQLArgInput, args...)
+	return val
+}
+
+func (r *ExtendedRequest) GetGraphQLArgArray_WithErr(args ...string) ([]interface{}, error) {
+	return r.getInputArray_WithErr_Helper(GetGraphQLArgInput, args...)
+}
+
+func (r *ExtendedRequest) GetGraphQLArgArray(args ...string) []interface{} {
+	val, _ := r.getInputArray_WithErr_Helper(GetGraphQLArgInput, args...)
+	return val
+}
+
 //
 // The default Get functions
 //
@@ -0,0 +1,114 @@
+package webauthn_firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	conduitUserBody = `{"user":{"username":"jake","email":"jake@jake.jake","password":"jakejake","bio":"I work at statefarm","image":null}}`
+
+	calypsoSettingsBody = `{"lang_id":"1","blog_public":"0","invitees":["alice@example.com","bob@example.com"],` +
+		`"old_domain":"old.wordpress.com","blogname":"new","domain":"wordpress.com","theme":"twentytwenty"}`
+
+	calypsoLoginBody = "username=jake&assertion=%7B%22id%22%3A%22abc%22%7D&redirect_to=%2F"
+)
+
+// The getters which the Conduit rules run on an update of the user and on a comment delete
+var conduitGetters = []getInput{
+	Get("user").SubField("username"),
+	Get("user").SubField("email"),
+	Get("user").SubField("password"),
+	Get("user").SubField("username"),
+	Get("user").SubField("email"),
+	Get_URL("slug"),
+	GetInt64_URL("comment_id"),
+}
+
+// The getters which the Calypso rules run on its `public-api.wordpress.com` routes
+var calypsoGetters = []getInput{
+	Get("lang_id"),
+	Get("blog_public"),
+	GetArray("invitees"),
+	Get("old_domain"),
+	Get("blogname"),
+	Get("domain"),
+	Get("theme"),
+}
+
+// The getters which the Calypso login runs on its `wordpress.com` form
+var calypsoLoginGetters = []getInput{
+	Get("username"),
+	Get("assertion"),
+	Get("username"),
+}
+
+func newBenchmarkRequest(method, body, contentType string, getInputDefault getInputFnType) *ExtendedRequest {
+	r := httptest.NewRequest(method, "/api/articles/how-to-train-your-dragon/comments/1", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r = mux.SetURLVars(r, map[string]string{
+		"slug":       "how-to-train-your-dragon",
+		"comment_id": "1",
+	})
+
+	return &ExtendedRequest{
+		Request:         r,
+		maxBodySize:     defaultMaxBodySize,
+		bodyMemoryLimit: defaultBodyMemoryLimit,
+		getInputDefault: getInputDefault,
+	}
+}
+
+// Forget the parsed body, as every getter did before the body was cached
+func resetParsedBody(r *ExtendedRequest) {
+	r.jsonParsed = false
+	r.jsonValue = nil
+	r.jsonErr = nil
+	r.formParsed = false
+	r.formErr = nil
+	r.Request.Form = nil
+	r.Request.PostForm = nil
+	r.Request.MultipartForm = nil
+}
+
+func benchmarkGetters(b *testing.B, getters []getInput, method, body, contentType string, getInputDefault getInputFnType) {
+	run := func(b *testing.B, cached bool) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			r := newBenchmarkRequest(method, body, contentType, getInputDefault)
+
+			for _, getter := range getters {
+				if !cached {
+					resetParsedBody(r)
+				}
+
+				getter.retrieve(r, nil)
+				if r.err != nil {
+					b.Fatalf("Getter %v failed: %v", getter.fields, r.err)
+				}
+			}
+
+			r.closeBody()
+		}
+	}
+
+	b.Run("uncached", func(b *testing.B) { run(b, false) })
+	b.Run("cached", func(b *testing.B) { run(b, true) })
+}
+
+func BenchmarkConduitRules(b *testing.B) {
+	benchmarkGetters(b, conduitGetters, http.MethodPut, conduitUserBody, "application/json", GetJSONInput)
+}
+
+func BenchmarkCalypsoRules(b *testing.B) {
+	benchmarkGetters(b, calypsoGetters, http.MethodPost, calypsoSettingsBody, "application/json", GetJSONInput)
+}
+
+func BenchmarkCalypsoLogin(b *testing.B) {
+	benchmarkGetters(b, calypsoLoginGetters, http.MethodPost, calypsoLoginBody, "application/x-www-form-urlencoded", GetFormInput)
+}
@@ -2,12 +2,13 @@ package webauthn_firewall
 
 import (
 	"crypto/tls"
-	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "unknwon.dev/clog/v2"
@@ -15,19 +16,27 @@ import (
 	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
 
 	"webauthn/webauthn"
-	"webauthn_utils/session"
 )
 
 const (
 	ENV_SESSION_KEY string = "SESSION_KEY"
 )
 
-var (
-	webauthnAPI  *webauthn.WebAuthn
-	sessionStore *session.Store
+// How to handle an assertion whose sign counter did not increase
+type CloneWarningPolicy int
+
+const (
+	// Reject the assertion and flag the credential
+	CloneWarningReject CloneWarningPolicy = iota
+	// Accept the assertion, but still flag the credential
+	CloneWarningFlag
 )
 
 type HandlerFnType func(http.ResponseWriter, *ExtendedRequest)
+
+// Creates the backend session of `userID` once they signed in with only their authenticator.
+// The function is responsible for writing the response, i.e. setting the session cookies
+type PasswordlessLoginFnType func(w http.ResponseWriter, r *ExtendedRequest, userID string) error
 type ContextGettersType map[string]func(...interface{}) (interface{}, error)
 
 type targetTuple struct {
@@ -67,10 +76,39 @@ type WebauthnFirewall struct {
 	// Private fields
 	router *mux.Router
 
-	getUserID      func(*http.Request) (int64, error)
+	// The router serving the requests, swapped out atomically on every reload
+	activeRouter atomic.Value
+	reloadLock   sync.Mutex
+	rulesSource  RulesSource
+	serving      bool
+	adminAddress string
+
+	rpID               string
+	webauthnCorePrefix string
+	loginURL           string
+
+	// The webauthn state of this firewall, so that several can run in one process
+	webauthnAPI    *webauthn.WebAuthn
+	sessionStore   SessionStore
+	store          db.Storage
+	challengeStore db.ChallengeStore
+	challengeTTL   time.Duration
+
+	cloneWarningPolicy  CloneWarningPolicy
+	registerAttestation *attestationVerifier
+
+	getUserID      func(*http.Request) (string, error)
 	contextGetters ContextGettersType
 
-	loginGetUsername func(*ExtendedRequest) (string, error)
+	loginGetUsername  func(*ExtendedRequest) (string, error)
+	passwordlessLogin PasswordlessLoginFnType
+
+	unmatchedRoutes UnmatchedRoutesPolicy
+	deniedRoutes    []RoutePattern
+	bindRequestBody bool
+
+	maxBodySize     int64
+	bodyMemoryLimit int64
 
 	supplyOptions bool
 	verbose       bool
@@ -84,21 +122,68 @@ type WebauthnFirewallConfig struct {
 	ReverseProxyTargetMap proxyTargetMap
 	ReverseProxyAddress   string
 
-	GetUserID      func(*http.Request) (int64, error)
-	ContextGetters ContextGettersType
+	// Resolves the opaque ID of the user of an incoming request. Either set the
+	// `IdentityProvider` to one of the built-in providers, or a custom `GetUserID` function
+	IdentityProvider IdentityProvider
+	GetUserID        func(*http.Request) (string, error)
+	ContextGetters   ContextGettersType
+
+	// Selects the storage driver and DSN of the credential database
+	Database db.Config
+
+	// Tracks the challenges so that each is used exactly once. Defaults to the credential database,
+	// which rules out replays across every replica sharing it. Issued challenges expire after
+	// the `ChallengeTTL`, which defaults to 5 minutes
+	ChallengeStore db.ChallengeStore
+	ChallengeTTL   time.Duration
+
+	// Where the session data of the ceremonies is kept. Defaults to encrypted
+	// cookies, keyed by the `SESSION_KEY` environment variable
+	Sessions SessionConfig
 
 	WebauthnCorePrefix string
 	LoginURL           string
 	LoginGetUsername   func(*ExtendedRequest) (string, error)
 
+	// Enables registering discoverable credentials and signing in
+	// without a username nor password when set
+	PasswordlessLogin PasswordlessLoginFnType
+
+	CloneWarningPolicy CloneWarningPolicy
+	Attestation        AttestationPolicy
+
+	// How requests matching none of the secured routes are handled. Allows them by default.
+	// Routes used without a signed in user, such as the sign up, need an exemption
+	// when unmatched requests require an assertion
+	UnmatchedRoutes UnmatchedRoutesPolicy
+
+	// Requests on these routes are refused before any route is matched, whatever their method.
+	// Deny the endpoints of the backend which only the firewall itself may call, i.e. "/server_context/**"
+	DeniedRoutes []RoutePattern
+
+	// Bind the assertions of every secured route to the request, as with the `BindRequestBody` option
+	BindRequestBody bool
+
+	// Bodies are only buffered on the routes which inspect them, and everything else streams to the
+	// backend. The `MaxBodySize` limits the inspected bodies, defaulting to 10 MiB, unless a route sets
+	// its own with the `MaxBodySize` option. Bodies above the `BodyMemoryLimit`, defaulting to 1 MiB,
+	// are spilled to a temporary file and streamed from there. GraphQL bodies, and the form and JSON
+	// bodies bound by `BindRequestBody`, are parsed in memory as a whole, so they are refused above
+	// the `BodyMemoryLimit`
+	MaxBodySize     int64
+	BodyMemoryLimit int64
+
+	// The address of the admin endpoint which reloads the routes, i.e. "127.0.0.1:9090".
+	// It has no authentication, so it should never be reachable from outside the host
+	AdminAddress string
+
 	SupplyOptions bool
 	Verbose       bool
 }
 
 func NewWebauthnFirewall(config *WebauthnFirewallConfig) *WebauthnFirewall {
 	// Initialize the Webauthn API code
-	var err error
-	webauthnAPI, err = webauthn.New(&webauthn.Config{
+	webauthnAPI, err := webauthn.New(&webauthn.Config{
 		RPDisplayName: config.RPDisplayName,
 		RPID:          config.RPID,
 		RPOrigin:      config.FrontendAddress, // Have the front-end be the origin URL for WebAuthn requests
@@ -107,12 +192,68 @@ func NewWebauthnFirewall(config *WebauthnFirewallConfig) *WebauthnFirewall {
 		panic("Unable to initialize Webauthn API: " + err.Error())
 	}
 
+	// Load the attestation policy which registrations must comply with
+	registerAttestation, err := newAttestationVerifier(config.Attestation)
+	if err != nil {
+		panic("Unable to load attestation policy: " + err.Error())
+	}
+
 	// Initialize the database for the firewall
 	log.Info("Starting up database")
-	if err = db.Init(); err != nil {
+	databaseConfig := config.Database
+	databaseConfig.RPID = config.RPID
+	store, err := db.NewStorage(databaseConfig)
+	if err != nil {
 		panic("Unable to initialize database: " + err.Error())
 	}
 
+	// Track the challenges in the credential database, unless another store is configured
+	challengeStore := config.ChallengeStore
+	if challengeStore == nil {
+		challengeStore = store
+	}
+
+	challengeTTL := config.ChallengeTTL
+	if challengeTTL <= 0 {
+		challengeTTL = defaultChallengeTTL
+	}
+
+	// Initialize the Webauthn `sessionStore`
+	sessionStore, err := newSessionStore(config.Sessions, store)
+	if err != nil {
+		panic("Unable to initialize webauthn session store: " + err.Error())
+	}
+
+	// The `IdentityProvider` takes precedence over a custom `GetUserID`
+	getUserID := config.GetUserID
+	if config.IdentityProvider != nil {
+		getUserID = config.IdentityProvider.GetUserID
+	}
+
+	if getUserID == nil {
+		panic("Either an IdentityProvider or GetUserID must be configured")
+	}
+
+	if err = config.UnmatchedRoutes.validate(); err != nil {
+		panic("Invalid unmatched routes policy: " + err.Error())
+	}
+
+	for _, denied := range config.DeniedRoutes {
+		if err = denied.validate(); err != nil {
+			panic(fmt.Sprintf("Malformed denied route %s: %v", denied.Path, err))
+		}
+	}
+
+	maxBodySize := config.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+
+	bodyMemoryLimit := config.BodyMemoryLimit
+	if bodyMemoryLimit <= 0 {
+		bodyMemoryLimit = defaultBodyMemoryLimit
+	}
+
 	// Construct and return the webauthn firewall
 	wfirewall := &WebauthnFirewall{
 		// Set the public fields
@@ -121,10 +262,34 @@ func NewWebauthnFirewall(config *WebauthnFirewallConfig) *WebauthnFirewall {
 		ReverseProxyAddress:   config.ReverseProxyAddress,
 
 		// Set the private fields
-		getUserID:      config.GetUserID,
+		adminAddress: config.AdminAddress,
+
+		rpID:               config.RPID,
+		webauthnCorePrefix: config.WebauthnCorePrefix,
+		loginURL:           config.LoginURL,
+
+		webauthnAPI:    webauthnAPI,
+		sessionStore:   sessionStore,
+		store:          store,
+		challengeStore: challengeStore,
+		challengeTTL:   challengeTTL,
+
+		// Set how sign counter regressions are handled
+		cloneWarningPolicy:  config.CloneWarningPolicy,
+		registerAttestation: registerAttestation,
+
+		getUserID:      getUserID,
 		contextGetters: config.ContextGetters,
 
-		loginGetUsername: config.LoginGetUsername,
+		loginGetUsername:  config.LoginGetUsername,
+		passwordlessLogin: config.PasswordlessLogin,
+
+		unmatchedRoutes: config.UnmatchedRoutes,
+		deniedRoutes:    config.DeniedRoutes,
+		bindRequestBody: config.BindRequestBody,
+
+		maxBodySize:     maxBodySize,
+		bodyMemoryLimit: bodyMemoryLimit,
 
 		supplyOptions: config.SupplyOptions,
 		verbose:       config.Verbose,
@@ -158,38 +323,92 @@ func NewWebauthnFirewall(config *WebauthnFirewallConfig) *WebauthnFirewall {
 
 	// Set the router to the `wfirewall`
 	wfirewall.router = mux.NewRouter()
+	wfirewall.registerCoreRoutes()
 
-	// Register the generic HTTP routes
-	wfirewall.Secure("GET", fmt.Sprintf("%s/is_enabled/{user}", config.WebauthnCorePrefix), wfirewall.webauthnIsEnabled)
+	return wfirewall
+}
+
+// The credential database of the firewall
+func (wfirewall *WebauthnFirewall) Store() db.Storage {
+	return wfirewall.store
+}
+
+// Register the generic HTTP routes. These are part of every router, including reloaded ones
+func (wfirewall *WebauthnFirewall) registerCoreRoutes() {
+	prefix := wfirewall.webauthnCorePrefix
 
-	wfirewall.Secure("POST", fmt.Sprintf("%s/begin_register", config.WebauthnCorePrefix), wfirewall.beginRegister)
-	wfirewall.Secure("POST", fmt.Sprintf("%s/finish_register", config.WebauthnCorePrefix), wfirewall.finishRegister)
+	wfirewall.Secure("GET", fmt.Sprintf("%s/is_enabled/{user}", prefix), wfirewall.webauthnIsEnabled)
 
-	wfirewall.Secure("POST", fmt.Sprintf("%s/begin_login", config.WebauthnCorePrefix), wfirewall.beginLogin)
+	wfirewall.Secure("POST", fmt.Sprintf("%s/begin_register", prefix), wfirewall.beginRegister)
+	wfirewall.Secure("POST", fmt.Sprintf("%s/finish_register", prefix), wfirewall.finishRegister)
+
+	wfirewall.Secure("POST", fmt.Sprintf("%s/begin_login", prefix), wfirewall.beginLogin)
 
 	// Use the provided `finishLogin` function under the user's discretion
-	if config.LoginURL != "" {
-		wfirewall.Secure("POST", config.LoginURL, wfirewall.finishLogin)
+	if wfirewall.loginURL != "" {
+		wfirewall.Secure("POST", wfirewall.loginURL, wfirewall.finishLogin)
 	}
 
-	wfirewall.Secure("POST", fmt.Sprintf("%s/begin_attestation", config.WebauthnCorePrefix), wfirewall.beginAttestation)
-	wfirewall.Secure("POST", fmt.Sprintf("%s/disable", config.WebauthnCorePrefix), wfirewall.disableWebauthn)
+	// Use the usernameless login under the user's discretion
+	if wfirewall.passwordlessLogin != nil {
+		wfirewall.Secure("POST", fmt.Sprintf("%s/begin_passwordless_login", prefix), wfirewall.beginPasswordlessLogin)
+		wfirewall.Secure("POST", fmt.Sprintf("%s/finish_passwordless_login", prefix), wfirewall.finishPasswordlessLogin)
+	}
 
-	return wfirewall
+	wfirewall.Secure("POST", fmt.Sprintf("%s/begin_attestation", prefix), wfirewall.beginAttestation)
+	wfirewall.Secure("POST", fmt.Sprintf("%s/disable", prefix), wfirewall.disableWebauthn)
+
+	// Register the per-credential management routes
+	wfirewall.Secure("GET", fmt.Sprintf("%s/credentials", prefix), wfirewall.listCredentials)
+	wfirewall.Secure("POST", fmt.Sprintf("%s/credentials/rename", prefix), wfirewall.renameCredential)
+	wfirewall.Secure("POST", fmt.Sprintf("%s/credentials/revoke", prefix), wfirewall.revokeCredential)
 }
 
-func (wfirewall *WebauthnFirewall) ListenAndServeTLS(cert, key string) {
-	// This function gets called once `wfirewall` has been entirely initialized.
-	// Catch all remaining requests and simply proxy them onward
+// Catch all remaining requests and handle them by the `unmatchedRoutes` policy. Every method
+// is caught, since the policy decides which methods are state-changing, i.e. PATCH
+func (wfirewall *WebauthnFirewall) registerCatchAll() {
 	wfirewall.router.PathPrefix("/").
-		HandlerFunc(wfirewall.wrapWithExtendedReq(wfirewall.proxyRequest)).
-		Methods("OPTIONS", "GET", "POST", "PUT", "DELETE")
+		HandlerFunc(wfirewall.wrapWithExtendedReq(wfirewall.unmatchedRequestHandler()))
+}
+
+func (wfirewall *WebauthnFirewall) ListenAndServeTLS(cert, key string) {
+	// This function gets called once `wfirewall` has been entirely initialized
+	wfirewall.reloadLock.Lock()
+	wfirewall.registerCatchAll()
+	wfirewall.activeRouter.Store(wfirewall.router)
+	wfirewall.serving = true
+	reloadable := wfirewall.rulesSource != nil
+	wfirewall.reloadLock.Unlock()
+
+	// Rebuild the routes from the `rulesSource` on request. Without one,
+	// SIGHUP keeps its default of terminating the firewall
+	if reloadable {
+		wfirewall.reloadOnSignal()
+	}
+	if wfirewall.adminAddress != "" {
+		go wfirewall.serveAdmin()
+	}
 
 	// Start up the server
 	log.Info("Starting up server on port: %s", wfirewall.ReverseProxyAddress)
 	log.Info("Forwarding HTTP: %s -> %v", wfirewall.ReverseProxyAddress, wfirewall.ReverseProxyTargetMap)
 
-	log.Fatal("%v", http.ListenAndServeTLS(wfirewall.ReverseProxyAddress, cert, key, wfirewall.router))
+	log.Fatal("%v", http.ListenAndServeTLS(wfirewall.ReverseProxyAddress, cert, key, http.HandlerFunc(wfirewall.serveActiveRouter)))
+}
+
+// Dispatch every request to the router which is active when the request arrives. In-flight
+// requests finish on the router they started on, so reloads never drop connections
+func (wfirewall *WebauthnFirewall) serveActiveRouter(w http.ResponseWriter, r *http.Request) {
+	// The denied routes take precedence over the secured ones, whose variables could match them otherwise
+	for _, denied := range wfirewall.deniedRoutes {
+		if denied.matches(r) {
+			log.Warn("Denied request: %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Route is not permitted by the firewall", http.StatusForbidden)
+			return
+		}
+	}
+
+	wfirewall.activeRouter.Load().(*mux.Router).ServeHTTP(w, r)
 }
 
 func (wfirewall *WebauthnFirewall) ServeHTTP(w http.ResponseWriter, r *ExtendedRequest) {
@@ -208,21 +427,4 @@ func init() {
 	if err != nil {
 		panic("Unable to create new logger: " + err.Error())
 	}
-
-	// Get the session key from the environment variable
-	sessionKey, err := hex.DecodeString(os.Getenv(ENV_SESSION_KEY))
-	if err != nil {
-		panic("Failed to decode session key env variable: " + err.Error())
-	}
-
-	if len(sessionKey) < session.DefaultEncryptionKeyLength {
-		panic(fmt.Sprintf("Session key not long enough: %d < %d",
-			len(sessionKey), session.DefaultEncryptionKeyLength))
-	}
-
-	// Initialize the Webauthn `sessionStore`
-	sessionStore, err = session.NewStore(sessionKey)
-	if err != nil {
-		panic("Failed to create webauthn session store: " + err.Error())
-	}
 }
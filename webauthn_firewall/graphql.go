@@ -0,0 +1,88 @@
+package webauthn_firewall
+
+import (
+	"net/http"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// Dispatches the requests of a GraphQL endpoint by the mutations they execute, since every
+// mutation shares the method and path of the endpoint. Register its `Handle` with `Secure`, for GET
+// as well, since an endpoint may execute the operations in the URL of a GET request:
+//
+//	router := wfirewall.NewGraphQLRouter().
+//		Mutation("deleteRepository", wfirewall.Authn("Confirm repository delete: %s", Get_GraphQLArg("id")))
+//	wfirewall.Secure("POST", "/graphql", router.Handle)
+//	wfirewall.Secure("GET", "/graphql", router.Handle)
+type GraphQLRouter struct {
+	mutations map[string]HandlerFnType
+	unmatched HandlerFnType
+}
+
+// Create a `GraphQLRouter` which proxies every operation until mutations are added to it
+func (wfirewall *WebauthnFirewall) NewGraphQLRouter() *GraphQLRouter {
+	return &GraphQLRouter{
+		mutations: make(map[string]HandlerFnType),
+		unmatched: wfirewall.ProxyRequest,
+	}
+}
+
+// Handle the mutations selecting the root `field` with `handleFn`
+func (g *GraphQLRouter) Mutation(field string, handleFn HandlerFnType) *GraphQLRouter {
+	g.mutations[field] = handleFn
+	return g
+}
+
+// Handle the mutations which select none of the routed fields with `handleFn`. They are proxied by default
+func (g *GraphQLRouter) Unmatched(handleFn HandlerFnType) *GraphQLRouter {
+	g.unmatched = handleFn
+	return g
+}
+
+func (g *GraphQLRouter) Handle(w http.ResponseWriter, r *ExtendedRequest) {
+	operation, err := r.GraphQL()
+	if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	// Only mutations change any state
+	if operation.OperationType != GraphQLMutation {
+		g.unmatched(w, r)
+		return
+	}
+
+	// GraphQL over HTTP only allows mutations in POST requests, which GET requests must not get around
+	if r.Request.Method == "GET" {
+		log.Warn("Denied GraphQL mutation over GET")
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "GraphQL mutations are not allowed over GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The root fields decide the route, since the operation name is chosen freely by the client
+	var routed *GraphQLField
+	for idx := range operation.RootFields {
+		if _, ok := g.mutations[operation.RootFields[idx].Name]; ok {
+			routed = &operation.RootFields[idx]
+			break
+		}
+	}
+
+	if routed == nil {
+		g.unmatched(w, r)
+		return
+	}
+
+	// A single assertion only approves a single mutation, so it may not be bundled with others
+	if len(operation.RootFields) != 1 {
+		log.Warn("Denied GraphQL mutation %s bundled with %d other fields", routed.Name, len(operation.RootFields)-1)
+		http.Error(w, "Secured GraphQL mutations must be the only field of their operation", http.StatusForbidden)
+		return
+	}
+
+	// Set the field for the `GetGraphQLArg` getters
+	r.graphQLField = routed
+
+	// Run the handler of the mutation
+	g.mutations[routed.Name](w, r)
+}
@@ -0,0 +1,897 @@
+package webauthn_firewall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The type of a GraphQL operation
+type GraphQLOperationType string
+
+const (
+	GraphQLQuery        GraphQLOperationType = "query"
+	GraphQLMutation     GraphQLOperationType = "mutation"
+	GraphQLSubscription GraphQLOperationType = "subscription"
+)
+
+// A field of the root selection set of a GraphQL operation, i.e. the mutation `deleteRepo`
+type GraphQLField struct {
+	Name  string
+	Alias string
+
+	// The argument values of the field, with the variables they refer to filled in.
+	// The numbers are `json.Number`, just like those of JSON request bodies
+	Arguments map[string]interface{}
+}
+
+// The GraphQL operation which a request executes
+type GraphQLRequest struct {
+	OperationName string
+	OperationType GraphQLOperationType
+	Variables     map[string]interface{}
+
+	// The root fields which the operation selects, including those selected
+	// through fragments. These, rather than the client chosen operation name,
+	// determine what the operation does
+	RootFields []GraphQLField
+}
+
+const (
+	// The deepest nesting of selection sets and values which is parsed
+	graphQLMaxDepth = 128
+	// The most root fields an operation may select, since fragments spreading
+	// each other repeatedly multiply the fields they select
+	graphQLMaxRootFields = 1024
+)
+
+// Parse the GraphQL operation of the request `r` with the `body`. The operation is either sent
+// as a JSON body, a body of content type "application/graphql" or in the URL of a GET request.
+// Batched operations are refused, since a single assertion cannot approve several of them
+func ParseGraphQLRequest(r *http.Request, body []byte) (*GraphQLRequest, error) {
+	var payload struct {
+		Query         string          `json:"query"`
+		OperationName string          `json:"operationName"`
+		Variables     json.RawMessage `json:"variables"`
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case r.Method == "GET":
+		params := r.URL.Query()
+		payload.Query = params.Get("query")
+		payload.OperationName = params.Get("operationName")
+		payload.Variables = json.RawMessage(params.Get("variables"))
+
+	case mediaType == "application/graphql":
+		params := r.URL.Query()
+		payload.Query = string(body)
+		payload.OperationName = params.Get("operationName")
+		payload.Variables = json.RawMessage(params.Get("variables"))
+
+	default:
+		trimmed := bytes.TrimSpace(body)
+		if len(trimmed) != 0 && trimmed[0] == '[' {
+			return nil, fmt.Errorf("Batched GraphQL requests are not supported")
+		}
+
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("Malformed GraphQL request: %v", err)
+		}
+	}
+
+	if payload.Query == "" {
+		return nil, fmt.Errorf("GraphQL request without a query")
+	}
+
+	// Unmarshal numbers into the `Number` type
+	variables := make(map[string]interface{})
+	if len(payload.Variables) != 0 && string(payload.Variables) != "null" {
+		dec := json.NewDecoder(bytes.NewReader(payload.Variables))
+		dec.UseNumber()
+		if err := dec.Decode(&variables); err != nil {
+			return nil, fmt.Errorf("Malformed GraphQL variables: %v", err)
+		}
+	}
+
+	document, err := parseGraphQLDocument(payload.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	operation, err := document.selectOperation(payload.OperationName)
+	if err != nil {
+		return nil, err
+	}
+
+	rootFields, err := document.rootFields(operation.selections, variables, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	// Success!
+	return &GraphQLRequest{
+		OperationName: operation.name,
+		OperationType: operation.operationType,
+		Variables:     variables,
+		RootFields:    rootFields,
+	}, nil
+}
+
+//
+// The GraphQL document
+//
+
+type graphQLSelection struct {
+	// A field, with its `name` set
+	name      string
+	alias     string
+	arguments map[string]interface{}
+
+	// A fragment spread, with its `fragment` set
+	fragment string
+
+	// An inline fragment, with its `selections` set
+	selections []graphQLSelection
+}
+
+type graphQLOperation struct {
+	name          string
+	operationType GraphQLOperationType
+	selections    []graphQLSelection
+}
+
+type graphQLDocument struct {
+	operations []graphQLOperation
+	fragments  map[string][]graphQLSelection
+}
+
+// A reference to a variable in an argument value, which is filled in once the variables are known
+type graphQLVariable string
+
+// Select the operation to execute, which must be named unless the document has only one
+func (d *graphQLDocument) selectOperation(operationName string) (*graphQLOperation, error) {
+	if operationName == "" {
+		if len(d.operations) != 1 {
+			return nil, fmt.Errorf("GraphQL documents with %d operations require an operation name", len(d.operations))
+		}
+		return &d.operations[0], nil
+	}
+
+	for idx := range d.operations {
+		if d.operations[idx].name == operationName {
+			return &d.operations[idx], nil
+		}
+	}
+
+	return nil, fmt.Errorf("GraphQL operation named %s not found", operationName)
+}
+
+// Collect the fields of the root `selections`, descending into fragments
+func (d *graphQLDocument) rootFields(
+	selections []graphQLSelection,
+	variables map[string]interface{},
+	visited map[string]bool) ([]GraphQLField, error) {
+
+	var fields []GraphQLField
+	for _, selection := range selections {
+		switch {
+		case selection.name != "":
+			arguments := make(map[string]interface{}, len(selection.arguments))
+			for name, value := range selection.arguments {
+				arguments[name] = resolveGraphQLVariables(value, variables)
+			}
+
+			fields = append(fields, GraphQLField{
+				Name:      selection.name,
+				Alias:     selection.alias,
+				Arguments: arguments,
+			})
+
+		case selection.fragment != "":
+			// A fragment which spreads itself is invalid, and would never terminate
+			if visited[selection.fragment] {
+				return nil, fmt.Errorf("GraphQL fragment %s spreads itself", selection.fragment)
+			}
+
+			fragment, ok := d.fragments[selection.fragment]
+			if !ok {
+				return nil, fmt.Errorf("GraphQL fragment %s not found", selection.fragment)
+			}
+
+			visited[selection.fragment] = true
+			fragmentFields, err := d.rootFields(fragment, variables, visited)
+			if err != nil {
+				return nil, err
+			}
+			delete(visited, selection.fragment)
+
+			fields = append(fields, fragmentFields...)
+
+		default:
+			fragmentFields, err := d.rootFields(selection.selections, variables, visited)
+			if err != nil {
+				return nil, err
+			}
+
+			fields = append(fields, fragmentFields...)
+		}
+
+		// Stop as soon as the limit is exceeded, rather than expanding every fragment first
+		if len(fields) > graphQLMaxRootFields {
+			return nil, fmt.Errorf("GraphQL operation selects more than %d root fields", graphQLMaxRootFields)
+		}
+	}
+
+	return fields, nil
+}
+
+// Fill in the `variables` which the argument `value` refers to. Undefined variables are null
+func resolveGraphQLVariables(value interface{}, variables map[string]interface{}) interface{} {
+	switch value := value.(type) {
+	case graphQLVariable:
+		return variables[string(value)]
+	case []interface{}:
+		resolved := make([]interface{}, len(value))
+		for idx, item := range value {
+			resolved[idx] = resolveGraphQLVariables(item, variables)
+		}
+		return resolved
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			resolved[key] = resolveGraphQLVariables(item, variables)
+		}
+		return resolved
+	}
+
+	return value
+}
+
+//
+// The GraphQL lexer
+//
+
+type graphQLTokenKind int
+
+const (
+	graphQLEOF graphQLTokenKind = iota
+	graphQLPunctuator
+	graphQLName
+	graphQLInt
+	graphQLFloat
+	graphQLString
+)
+
+type graphQLToken struct {
+	kind  graphQLTokenKind
+	value string
+}
+
+type graphQLLexer struct {
+	source string
+	pos    int
+}
+
+// Skip the whitespace, commas and comments, which carry no meaning
+func (l *graphQLLexer) skipIgnored() {
+	for l.pos < len(l.source) {
+		switch c := l.source[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.source) && l.source[l.pos] != '\n' && l.source[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.source[l.pos:], "\uFEFF"):
+			l.pos += len("\uFEFF")
+		default:
+			return
+		}
+	}
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isGraphQLDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (l *graphQLLexer) next() (graphQLToken, error) {
+	l.skipIgnored()
+	if l.pos >= len(l.source) {
+		return graphQLToken{kind: graphQLEOF}, nil
+	}
+
+	start := l.pos
+	c := l.source[l.pos]
+	switch {
+	case strings.HasPrefix(l.source[l.pos:], "..."):
+		l.pos += 3
+		return graphQLToken{kind: graphQLPunctuator, value: "..."}, nil
+
+	case strings.IndexByte("!$&()/:=@[]{|}", c) >= 0:
+		l.pos++
+		return graphQLToken{kind: graphQLPunctuator, value: string(c)}, nil
+
+	case isGraphQLNameStart(c):
+		for l.pos < len(l.source) && (isGraphQLNameStart(l.source[l.pos]) || isGraphQLDigit(l.source[l.pos])) {
+			l.pos++
+		}
+		return graphQLToken{kind: graphQLName, value: l.source[start:l.pos]}, nil
+
+	case c == '-' || isGraphQLDigit(c):
+		return l.lexNumber()
+
+	case strings.HasPrefix(l.source[l.pos:], `"""`):
+		return l.lexBlockString()
+
+	case c == '"':
+		return l.lexString()
+	}
+
+	return graphQLToken{}, fmt.Errorf("Unexpected character %q in GraphQL document at %d", c, l.pos)
+}
+
+func (l *graphQLLexer) lexNumber() (graphQLToken, error) {
+	start := l.pos
+	kind := graphQLInt
+
+	if l.source[l.pos] == '-' {
+		l.pos++
+	}
+
+	digits := func() int {
+		digitsStart := l.pos
+		for l.pos < len(l.source) && isGraphQLDigit(l.source[l.pos]) {
+			l.pos++
+		}
+		return l.pos - digitsStart
+	}
+
+	if digits() == 0 {
+		return graphQLToken{}, fmt.Errorf("Malformed GraphQL number at %d", start)
+	}
+
+	if l.pos < len(l.source) && l.source[l.pos] == '.' {
+		kind = graphQLFloat
+		l.pos++
+		if digits() == 0 {
+			return graphQLToken{}, fmt.Errorf("Malformed GraphQL number at %d", start)
+		}
+	}
+
+	if l.pos < len(l.source) && (l.source[l.pos] == 'e' || l.source[l.pos] == 'E') {
+		kind = graphQLFloat
+		l.pos++
+		if l.pos < len(l.source) && (l.source[l.pos] == '+' || l.source[l.pos] == '-') {
+			l.pos++
+		}
+		if digits() == 0 {
+			return graphQLToken{}, fmt.Errorf("Malformed GraphQL number at %d", start)
+		}
+	}
+
+	return graphQLToken{kind: kind, value: l.source[start:l.pos]}, nil
+}
+
+func (l *graphQLLexer) lexString() (graphQLToken, error) {
+	start := l.pos
+	l.pos++
+
+	var value strings.Builder
+	for l.pos < len(l.source) {
+		c := l.source[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return graphQLToken{kind: graphQLString, value: value.String()}, nil
+
+		case c == '\n' || c == '\r':
+			return graphQLToken{}, fmt.Errorf("Unterminated GraphQL string at %d", start)
+
+		case c == '\\':
+			if l.pos+1 >= len(l.source) {
+				return graphQLToken{}, fmt.Errorf("Unterminated GraphQL string at %d", start)
+			}
+
+			escape := l.source[l.pos+1]
+			l.pos += 2
+			switch escape {
+			case '"', '\\', '/':
+				value.WriteByte(escape)
+			case 'b':
+				value.WriteByte('\b')
+			case 'f':
+				value.WriteByte('\f')
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case 'u':
+				if l.pos+4 > len(l.source) {
+					return graphQLToken{}, fmt.Errorf("Malformed GraphQL unicode escape at %d", l.pos)
+				}
+				code, err := strconv.ParseUint(l.source[l.pos:l.pos+4], 16, 32)
+				if err != nil {
+					return graphQLToken{}, fmt.Errorf("Malformed GraphQL unicode escape at %d", l.pos)
+				}
+				value.WriteRune(rune(code))
+				l.pos += 4
+			default:
+				return graphQLToken{}, fmt.Errorf("Unknown GraphQL string escape \\%c at %d", escape, l.pos)
+			}
+
+		default:
+			r, size := utf8.DecodeRuneInString(l.source[l.pos:])
+			value.WriteRune(r)
+			l.pos += size
+		}
+	}
+
+	return graphQLToken{}, fmt.Errorf("Unterminated GraphQL string at %d", start)
+}
+
+func (l *graphQLLexer) lexBlockString() (graphQLToken, error) {
+	start := l.pos
+	l.pos += 3
+
+	var raw strings.Builder
+	for l.pos < len(l.source) {
+		switch {
+		case strings.HasPrefix(l.source[l.pos:], `"""`):
+			l.pos += 3
+			return graphQLToken{kind: graphQLString, value: blockStringValue(raw.String())}, nil
+		case strings.HasPrefix(l.source[l.pos:], `\"""`):
+			raw.WriteString(`"""`)
+			l.pos += 4
+		default:
+			raw.WriteByte(l.source[l.pos])
+			l.pos++
+		}
+	}
+
+	return graphQLToken{}, fmt.Errorf("Unterminated GraphQL block string at %d", start)
+}
+
+// Remove the common indentation and the surrounding blank lines of a block string
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(raw), "\n")
+
+	commonIndent := -1
+	for _, line := range lines[1:] {
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < len(line) && (commonIndent < 0 || indent < commonIndent) {
+			commonIndent = indent
+		}
+	}
+
+	if commonIndent > 0 {
+		for idx := 1; idx < len(lines); idx++ {
+			if len(lines[idx]) >= commonIndent {
+				lines[idx] = lines[idx][commonIndent:]
+			} else {
+				lines[idx] = ""
+			}
+		}
+	}
+
+	for len(lines) != 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) != 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+//
+// The GraphQL parser
+//
+
+type graphQLParser struct {
+	lexer *graphQLLexer
+	token graphQLToken
+	depth int
+}
+
+func parseGraphQLDocument(source string) (*graphQLDocument, error) {
+	p := &graphQLParser{lexer: &graphQLLexer{source: source}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	document := &graphQLDocument{fragments: make(map[string][]graphQLSelection)}
+	for p.token.kind != graphQLEOF {
+		if err := p.parseDefinition(document); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(document.operations) == 0 {
+		return nil, fmt.Errorf("GraphQL document without an operation")
+	}
+
+	return document, nil
+}
+
+func (p *graphQLParser) advance() (err error) {
+	p.token, err = p.lexer.next()
+	return err
+}
+
+func (p *graphQLParser) peek(kind graphQLTokenKind, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+func (p *graphQLParser) expect(kind graphQLTokenKind, value string) error {
+	if !p.peek(kind, value) {
+		return fmt.Errorf("Expected %s in GraphQL document, found %q", value, p.token.value)
+	}
+	return p.advance()
+}
+
+func (p *graphQLParser) expectName() (string, error) {
+	if p.token.kind != graphQLName {
+		return "", fmt.Errorf("Expected a name in GraphQL document, found %q", p.token.value)
+	}
+
+	name := p.token.value
+	return name, p.advance()
+}
+
+// Guard against documents nested deeply enough to exhaust the parser
+func (p *graphQLParser) enter() error {
+	p.depth++
+	if p.depth > graphQLMaxDepth {
+		return fmt.Errorf("GraphQL document is nested too deeply")
+	}
+	return nil
+}
+
+func (p *graphQLParser) leave() {
+	p.depth--
+}
+
+func (p *graphQLParser) parseDefinition(document *graphQLDocument) error {
+	// The shorthand form of a query
+	if p.peek(graphQLPunctuator, "{") {
+		selections, err := p.parseSelectionSet()
+		if err != nil {
+			return err
+		}
+
+		document.operations = append(document.operations, graphQLOperation{
+			operationType: GraphQLQuery,
+			selections:    selections,
+		})
+		return nil
+	}
+
+	keyword, err := p.expectName()
+	if err != nil {
+		return err
+	}
+
+	switch GraphQLOperationType(keyword) {
+	case GraphQLQuery, GraphQLMutation, GraphQLSubscription:
+		operation := graphQLOperation{operationType: GraphQLOperationType(keyword)}
+		if p.token.kind == graphQLName {
+			operation.name = p.token.value
+			if err := p.advance(); err != nil {
+				return err
+			}
+		}
+
+		// The variable definitions do not matter, only the values of the variables do
+		if p.peek(graphQLPunctuator, "(") {
+			if err := p.skipBalanced("(", ")"); err != nil {
+				return err
+			}
+		}
+
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+
+		if operation.selections, err = p.parseSelectionSet(); err != nil {
+			return err
+		}
+
+		document.operations = append(document.operations, operation)
+		return nil
+	}
+
+	if keyword != "fragment" {
+		return fmt.Errorf("Unsupported GraphQL definition: %s", keyword)
+	}
+
+	name, err := p.expectName()
+	if err != nil {
+		return err
+	}
+
+	if err := p.expect(graphQLName, "on"); err != nil {
+		return err
+	}
+
+	if _, err := p.expectName(); err != nil {
+		return err
+	}
+
+	if err := p.skipDirectives(); err != nil {
+		return err
+	}
+
+	if _, ok := document.fragments[name]; ok {
+		return fmt.Errorf("GraphQL fragment %s is defined more than once", name)
+	}
+
+	document.fragments[name], err = p.parseSelectionSet()
+	return err
+}
+
+func (p *graphQLParser) parseSelectionSet() ([]graphQLSelection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	if err := p.expect(graphQLPunctuator, "{"); err != nil {
+		return nil, err
+	}
+
+	var selections []graphQLSelection
+	for !p.peek(graphQLPunctuator, "}") {
+		if p.token.kind == graphQLEOF {
+			return nil, fmt.Errorf("Unterminated GraphQL selection set")
+		}
+
+		selection, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+
+	return selections, p.advance()
+}
+
+func (p *graphQLParser) parseSelection() (graphQLSelection, error) {
+	var selection graphQLSelection
+
+	if p.peek(graphQLPunctuator, "...") {
+		if err := p.advance(); err != nil {
+			return selection, err
+		}
+
+		// A fragment spread
+		if p.token.kind == graphQLName && p.token.value != "on" {
+			selection.fragment = p.token.value
+			if err := p.advance(); err != nil {
+				return selection, err
+			}
+			return selection, p.skipDirectives()
+		}
+
+		// An inline fragment, with an optional type condition
+		if p.peek(graphQLName, "on") {
+			if err := p.advance(); err != nil {
+				return selection, err
+			}
+			if _, err := p.expectName(); err != nil {
+				return selection, err
+			}
+		}
+
+		if err := p.skipDirectives(); err != nil {
+			return selection, err
+		}
+
+		var err error
+		selection.selections, err = p.parseSelectionSet()
+		return selection, err
+	}
+
+	// A field, with an optional alias
+	name, err := p.expectName()
+	if err != nil {
+		return selection, err
+	}
+	selection.name = name
+
+	if p.peek(graphQLPunctuator, ":") {
+		if err := p.advance(); err != nil {
+			return selection, err
+		}
+		selection.alias = name
+		if selection.name, err = p.expectName(); err != nil {
+			return selection, err
+		}
+	}
+
+	selection.arguments = make(map[string]interface{})
+	if p.peek(graphQLPunctuator, "(") {
+		if selection.arguments, err = p.parseArguments(); err != nil {
+			return selection, err
+		}
+	}
+
+	if err := p.skipDirectives(); err != nil {
+		return selection, err
+	}
+
+	// The nested selections do not matter, only the root fields do
+	if p.peek(graphQLPunctuator, "{") {
+		if _, err := p.parseSelectionSet(); err != nil {
+			return selection, err
+		}
+	}
+
+	return selection, nil
+}
+
+func (p *graphQLParser) parseArguments() (map[string]interface{}, error) {
+	if err := p.expect(graphQLPunctuator, "("); err != nil {
+		return nil, err
+	}
+
+	arguments := make(map[string]interface{})
+	for !p.peek(graphQLPunctuator, ")") {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(graphQLPunctuator, ":"); err != nil {
+			return nil, err
+		}
+
+		if _, ok := arguments[name]; ok {
+			return nil, fmt.Errorf("GraphQL argument %s is given more than once", name)
+		}
+
+		if arguments[name], err = p.parseValue(); err != nil {
+			return nil, err
+		}
+	}
+
+	return arguments, p.advance()
+}
+
+func (p *graphQLParser) parseValue() (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	token := p.token
+	switch token.kind {
+	case graphQLInt, graphQLFloat:
+		return json.Number(token.value), p.advance()
+
+	case graphQLString:
+		return token.value, p.advance()
+
+	case graphQLName:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		switch token.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+
+		// Enum values are represented by their name
+		return token.value, nil
+
+	case graphQLPunctuator:
+		switch token.value {
+		case "$":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+
+			name, err := p.expectName()
+			return graphQLVariable(name), err
+
+		case "[":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+
+			list := make([]interface{}, 0)
+			for !p.peek(graphQLPunctuator, "]") {
+				item, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, p.advance()
+
+		case "{":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+
+			object := make(map[string]interface{})
+			for !p.peek(graphQLPunctuator, "}") {
+				name, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+
+				if err := p.expect(graphQLPunctuator, ":"); err != nil {
+					return nil, err
+				}
+
+				if object[name], err = p.parseValue(); err != nil {
+					return nil, err
+				}
+			}
+			return object, p.advance()
+		}
+	}
+
+	return nil, fmt.Errorf("Unexpected %q in GraphQL value", token.value)
+}
+
+// Skip over the directives, i.e. `@include(if: $flag)`
+func (p *graphQLParser) skipDirectives() error {
+	for p.peek(graphQLPunctuator, "@") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+
+		if _, err := p.expectName(); err != nil {
+			return err
+		}
+
+		if p.peek(graphQLPunctuator, "(") {
+			if _, err := p.parseArguments(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Skip over the tokens from `open` up to its matching `close`
+func (p *graphQLParser) skipBalanced(open, close string) error {
+	nesting := 0
+	for {
+		switch {
+		case p.token.kind == graphQLEOF:
+			return fmt.Errorf("Unterminated %s in GraphQL document", open)
+		case p.peek(graphQLPunctuator, open):
+			nesting++
+		case p.peek(graphQLPunctuator, close):
+			nesting--
+		}
+
+		if err := p.advance(); err != nil {
+			return err
+		}
+
+		if nesting == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package webauthn_firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newGraphQLRequest(t *testing.T, query, operationName, variables string) (*http.Request, []byte) {
+	payload := map[string]interface{}{
+		"query":         query,
+		"operationName": operationName,
+	}
+	if variables != "" {
+		payload["variables"] = json.RawMessage(variables)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/graphql", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	return r, body
+}
+
+func TestParseGraphQLRequest(t *testing.T) {
+	deleteRepository := GraphQLField{
+		Name:      "deleteRepository",
+		Arguments: map[string]interface{}{"id": "R_1"},
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+		variables     string
+
+		wantType   GraphQLOperationType
+		wantName   string
+		wantFields []GraphQLField
+		wantErr    string
+	}{
+		{
+			name:       "shorthand query",
+			query:      `{ viewer { login } }`,
+			wantType:   GraphQLQuery,
+			wantFields: []GraphQLField{{Name: "viewer", Arguments: map[string]interface{}{}}},
+		},
+		{
+			name:       "mutation",
+			query:      `mutation Delete { deleteRepository(id: "R_1") { id } }`,
+			wantType:   GraphQLMutation,
+			wantName:   "Delete",
+			wantFields: []GraphQLField{deleteRepository},
+		},
+		{
+			name:     "alias",
+			query:    `mutation { starred: deleteRepository(id: "R_1") { id } }`,
+			wantType: GraphQLMutation,
+			wantFields: []GraphQLField{{
+				Name:      "deleteRepository",
+				Alias:     "starred",
+				Arguments: map[string]interface{}{"id": "R_1"},
+			}},
+		},
+		{
+			name:       "fragment spread hiding a mutation",
+			query:      `mutation AddStar { ...Harmless } fragment Harmless on Mutation { deleteRepository(id: "R_1") { id } }`,
+			wantType:   GraphQLMutation,
+			wantName:   "AddStar",
+			wantFields: []GraphQLField{deleteRepository},
+		},
+		{
+			name:       "inline fragment hiding a mutation",
+			query:      `mutation { ... on Mutation { ... @include(if: true) { deleteRepository(id: "R_1") } } }`,
+			wantType:   GraphQLMutation,
+			wantFields: []GraphQLField{deleteRepository},
+		},
+		{
+			name: "nested fragment spreads",
+			query: `mutation { ...Outer }
+				fragment Outer on Mutation { ...Inner }
+				fragment Inner on Mutation { deleteRepository(id: "R_1") }`,
+			wantType:   GraphQLMutation,
+			wantFields: []GraphQLField{deleteRepository},
+		},
+		{
+			name:      "variables",
+			query:     `mutation Delete($id: ID!, $count: Int = 1) { deleteRepository(id: $id, input: {count: $count, tags: [$id, "x"], missing: $undefined}) }`,
+			variables: `{"id": "R_1", "count": 3}`,
+			wantType:  GraphQLMutation,
+			wantName:  "Delete",
+			wantFields: []GraphQLField{{
+				Name: "deleteRepository",
+				Arguments: map[string]interface{}{
+					"id": "R_1",
+					"input": map[string]interface{}{
+						"count":   json.Number("3"),
+						"tags":    []interface{}{"R_1", "x"},
+						"missing": nil,
+					},
+				},
+			}},
+		},
+		{
+			name:     "literal values",
+			query:    `mutation { updateRepository(size: -1.5e3, public: false, topics: [], visibility: PRIVATE, owner: null) }`,
+			wantType: GraphQLMutation,
+			wantFields: []GraphQLField{{
+				Name: "updateRepository",
+				Arguments: map[string]interface{}{
+					"size":       json.Number("-1.5e3"),
+					"public":     false,
+					"topics":     []interface{}{},
+					"visibility": "PRIVATE",
+					"owner":      nil,
+				},
+			}},
+		},
+		{
+			name:          "operation name selects the mutation",
+			query:         `query Viewer { viewer { login } } mutation Delete { deleteRepository(id: "R_1") }`,
+			operationName: "Delete",
+			wantType:      GraphQLMutation,
+			wantName:      "Delete",
+			wantFields:    []GraphQLField{deleteRepository},
+		},
+		{
+			name:          "operation name selects the query",
+			query:         `query Viewer { viewer { login } } mutation Delete { deleteRepository(id: "R_1") }`,
+			operationName: "Viewer",
+			wantType:      GraphQLQuery,
+			wantName:      "Viewer",
+			wantFields:    []GraphQLField{{Name: "viewer", Arguments: map[string]interface{}{}}},
+		},
+		{
+			name: "comments and commas",
+			query: "\uFEFF# deleteRepository(id: \"R_2\")\n" +
+				"mutation { # viewer\n deleteRepository(id: \"R_1\",,, # id: \"R_3\"\n) }",
+			wantType:   GraphQLMutation,
+			wantFields: []GraphQLField{deleteRepository},
+		},
+		{
+			name:     "string escapes",
+			query:    `mutation { createIssue(title: "a \"quoted\" \\ é\n# not a comment } deleteRepository") }`,
+			wantType: GraphQLMutation,
+			wantFields: []GraphQLField{{
+				Name:      "createIssue",
+				Arguments: map[string]interface{}{"title": "a \"quoted\" \\ é\n# not a comment } deleteRepository"},
+			}},
+		},
+		{
+			name:     "block string",
+			query:    "mutation { createIssue(body: \"\"\"\n    Hello,\n      \\\"\"\" world }\n    \"\"\") }",
+			wantType: GraphQLMutation,
+			wantFields: []GraphQLField{{
+				Name:      "createIssue",
+				Arguments: map[string]interface{}{"body": "Hello,\n  \"\"\" world }"},
+			}},
+		},
+		{
+			name: "bundled mutation",
+			query: `mutation { addStar(starrableId: "S_1") { clientMutationId }
+				...Hidden }
+				fragment Hidden on Mutation { deleteRepository(id: "R_1") }`,
+			wantType: GraphQLMutation,
+			wantFields: []GraphQLField{
+				{Name: "addStar", Arguments: map[string]interface{}{"starrableId": "S_1"}},
+				deleteRepository,
+			},
+		},
+		{
+			name:    "several operations without an operation name",
+			query:   `query Viewer { viewer { login } } mutation Delete { deleteRepository(id: "R_1") }`,
+			wantErr: "require an operation name",
+		},
+		{
+			name:          "unknown operation name",
+			query:         `mutation Delete { deleteRepository(id: "R_1") }`,
+			operationName: "Viewer",
+			wantErr:       "not found",
+		},
+		{
+			name:    "fragment cycle",
+			query:   `mutation { ...A } fragment A on Mutation { ...B } fragment B on Mutation { ...A }`,
+			wantErr: "spreads itself",
+		},
+		{
+			name:    "unknown fragment",
+			query:   `mutation { ...A }`,
+			wantErr: "not found",
+		},
+		{
+			name:    "duplicate fragment",
+			query:   `mutation { ...A } fragment A on Mutation { a } fragment A on Mutation { b }`,
+			wantErr: "more than once",
+		},
+		{
+			// Every fragment spreads the previous one twice, selecting 2^40 root fields in the end
+			name: "fragments multiplying the root fields",
+			query: func() string {
+				query := "mutation { ...F40 } fragment F0 on Mutation { a }"
+				for i := 1; i <= 40; i++ {
+					query += fmt.Sprintf(" fragment F%d on Mutation { ...F%d ...F%d }", i, i-1, i-1)
+				}
+				return query
+			}(),
+			wantErr: "root fields",
+		},
+		{
+			name:    "unterminated string",
+			query:   `mutation { deleteRepository(id: "R_1) }`,
+			wantErr: "Unterminated",
+		},
+		{
+			name:    "unknown escape",
+			query:   `mutation { deleteRepository(id: "R\_1") }`,
+			wantErr: "Unknown GraphQL string escape",
+		},
+		{
+			name:    "nested too deeply",
+			query:   "mutation { deleteRepository(id: " + strings.Repeat("[", graphQLMaxDepth+1) + strings.Repeat("]", graphQLMaxDepth+1) + ") }",
+			wantErr: "nested too deeply",
+		},
+		{
+			name:      "malformed variables",
+			query:     `mutation { deleteRepository(id: $id) }`,
+			variables: `["R_1"]`,
+			wantErr:   "Malformed GraphQL variables",
+		},
+		{
+			name:    "empty query",
+			query:   "",
+			wantErr: "without a query",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, body := newGraphQLRequest(t, test.query, test.operationName, test.variables)
+			operation, err := ParseGraphQLRequest(r, body)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Expected an error containing %q, got: %v", test.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if operation.OperationType != test.wantType {
+				t.Errorf("Operation type: got %s, want %s", operation.OperationType, test.wantType)
+			}
+			if operation.OperationName != test.wantName {
+				t.Errorf("Operation name: got %q, want %q", operation.OperationName, test.wantName)
+			}
+			if !reflect.DeepEqual(operation.RootFields, test.wantFields) {
+				t.Errorf("Root fields: got %#v, want %#v", operation.RootFields, test.wantFields)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLRequest_Transports(t *testing.T) {
+	query := `mutation Delete($id: ID!) { deleteRepository(id: $id) }`
+	params := url.Values{
+		"query":         {query},
+		"operationName": {"Delete"},
+		"variables":     {`{"id": "R_1"}`},
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+
+		wantFields []GraphQLField
+		wantErr    string
+	}{
+		{
+			name:   "GET",
+			method: "GET",
+			target: "/graphql?" + params.Encode(),
+			wantFields: []GraphQLField{{
+				Name:      "deleteRepository",
+				Arguments: map[string]interface{}{"id": "R_1"},
+			}},
+		},
+		{
+			name:        "application/graphql",
+			method:      "POST",
+			target:      "/graphql?" + url.Values{"variables": {`{"id": "R_1"}`}}.Encode(),
+			contentType: "application/graphql; charset=utf-8",
+			body:        query,
+			wantFields: []GraphQLField{{
+				Name:      "deleteRepository",
+				Arguments: map[string]interface{}{"id": "R_1"},
+			}},
+		},
+		{
+			name:        "batched",
+			method:      "POST",
+			target:      "/graphql",
+			contentType: "application/json",
+			body:        ` [{"query": "mutation { deleteRepository(id: \"R_1\") }"}]`,
+			wantErr:     "Batched GraphQL requests are not supported",
+		},
+		{
+			name:        "malformed JSON",
+			method:      "POST",
+			target:      "/graphql",
+			contentType: "application/json",
+			body:        `{"query": `,
+			wantErr:     "Malformed GraphQL request",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+
+			operation, err := ParseGraphQLRequest(r, []byte(test.body))
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Expected an error containing %q, got: %v", test.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(operation.RootFields, test.wantFields) {
+				t.Errorf("Root fields: got %#v, want %#v", operation.RootFields, test.wantFields)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package webauthn_firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLRouter(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+
+		wantStatus  int
+		wantHandler string
+		wantArg     string
+	}{
+		{
+			name:        "secured mutation",
+			method:      "POST",
+			target:      "/graphql",
+			body:        `{"query": "mutation Star { gone: deleteRepository(id: $id) { id } }", "variables": {"id": "R_1"}}`,
+			wantStatus:  http.StatusOK,
+			wantHandler: "deleteRepository",
+			wantArg:     "R_1",
+		},
+		{
+			name:        "secured mutation in a fragment",
+			method:      "POST",
+			target:      "/graphql",
+			body:        `{"query": "mutation { ...F } fragment F on Mutation { deleteRepository(id: \"R_1\") }"}`,
+			wantStatus:  http.StatusOK,
+			wantHandler: "deleteRepository",
+			wantArg:     "R_1",
+		},
+		{
+			name:        "query",
+			method:      "POST",
+			target:      "/graphql",
+			body:        `{"query": "{ deleteRepository(id: \"R_1\") }"}`,
+			wantStatus:  http.StatusOK,
+			wantHandler: "unmatched",
+		},
+		{
+			name:        "unsecured mutation",
+			method:      "POST",
+			target:      "/graphql",
+			body:        `{"query": "mutation { addStar(starrableId: \"S_1\") { clientMutationId } }"}`,
+			wantStatus:  http.StatusOK,
+			wantHandler: "unmatched",
+		},
+		{
+			name:       "secured mutation bundled with another field",
+			method:     "POST",
+			target:     "/graphql",
+			body:       `{"query": "mutation { addStar(starrableId: \"S_1\") { clientMutationId } deleteRepository(id: \"R_1\") }"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "secured mutation bundled through a fragment",
+			method:     "POST",
+			target:     "/graphql",
+			body:       `{"query": "mutation { addStar(starrableId: \"S_1\") { clientMutationId } ...F } fragment F on Mutation { deleteRepository(id: \"R_1\") }"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "secured mutation bundled with itself",
+			method:     "POST",
+			target:     "/graphql",
+			body:       `{"query": "mutation { a: deleteRepository(id: \"R_1\") b: deleteRepository(id: \"R_2\") }"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "batched secured mutation",
+			method:     "POST",
+			target:     "/graphql",
+			body:       `[{"query": "mutation { deleteRepository(id: \"R_1\") }"}]`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "query over GET",
+			method:      "GET",
+			target:      "/graphql?" + url.Values{"query": {`{ repository(id: "R_1") { name } }`}}.Encode(),
+			wantStatus:  http.StatusOK,
+			wantHandler: "unmatched",
+		},
+		{
+			name:       "secured mutation over GET",
+			method:     "GET",
+			target:     "/graphql?" + url.Values{"query": {`mutation { deleteRepository(id: "R_1") }`}}.Encode(),
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "unsecured mutation over GET",
+			method:     "GET",
+			target:     "/graphql?" + url.Values{"query": {`mutation { addStar(starrableId: "S_1") { clientMutationId } }`}}.Encode(),
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var handled, arg string
+			router := (&WebauthnFirewall{}).NewGraphQLRouter().
+				Mutation("deleteRepository", func(w http.ResponseWriter, r *ExtendedRequest) {
+					handled = "deleteRepository"
+					arg = r.GetGraphQLArg("id")
+				}).
+				Unmatched(func(w http.ResponseWriter, r *ExtendedRequest) {
+					handled = "unmatched"
+				})
+
+			r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/json")
+			extendedReq := &ExtendedRequest{
+				Request:         r,
+				maxBodySize:     defaultMaxBodySize,
+				bodyMemoryLimit: defaultBodyMemoryLimit,
+				getInputDefault: GetJSONInput,
+			}
+			defer extendedReq.closeBody()
+
+			w := httptest.NewRecorder()
+			router.Handle(w, extendedReq)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("Status: got %d, want %d: %s", w.Code, test.wantStatus, w.Body.String())
+			}
+			if handled != test.wantHandler {
+				t.Errorf("Handler: got %q, want %q", handled, test.wantHandler)
+			}
+			if arg != test.wantArg {
+				t.Errorf("Argument id: got %q, want %q", arg, test.wantArg)
+			}
+		})
+	}
+}
@@ -0,0 +1,485 @@
+package webauthn_firewall
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/tool"
+)
+
+// Resolves the opaque ID of the backend user which an incoming request is authenticated
+// as. This is to assure that the server and the firewall are referencing the same user
+// during the webauthn check. Numeric IDs are represented in their decimal form
+type IdentityProvider interface {
+	GetUserID(r *http.Request) (string, error)
+}
+
+// The most entries an `identityCache` holds before it sweeps out the expired ones
+const identityCacheSweepSize = 4096
+
+type identityCacheEntry struct {
+	userID  string
+	expires time.Time
+}
+
+// Caches the resolved user IDs keyed by the credentials of a request, i.e. its cookies
+// or token. The keys are hashed so that no session secrets are kept around in memory
+type identityCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]identityCacheEntry
+}
+
+func newIdentityCache(ttl time.Duration) *identityCache {
+	return &identityCache{
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]identityCacheEntry),
+	}
+}
+
+func (c *identityCache) get(key string) (string, bool) {
+	// Caching is disabled or there is nothing to key on
+	if c.ttl <= 0 || key == "" {
+		return "", false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[sha256.Sum256([]byte(key))]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+
+	return entry.userID, true
+}
+
+// Cache the `userID` of `key` for the TTL of the cache, but no later than `notAfter` when set
+func (c *identityCache) set(key string, userID string, notAfter time.Time) {
+	if c.ttl <= 0 || key == "" {
+		return
+	}
+
+	expires := time.Now().Add(c.ttl)
+	if !notAfter.IsZero() && notAfter.Before(expires) {
+		expires = notAfter
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.entries) >= identityCacheSweepSize {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	c.entries[sha256.Sum256([]byte(key))] = identityCacheEntry{userID: userID, expires: expires}
+}
+
+//
+// Backend introspection
+//
+
+type BackendIdentityConfig struct {
+	// The backend URL which describes the user of the forwarded credentials
+	URL string
+	// Defaults to "GET"
+	Method string
+
+	// Forward the cookies of the incoming request, i.e. the one with the session ID
+	ForwardCookies bool
+	// The headers of the incoming request to forward, i.e. "Authorization"
+	ForwardHeaders []string
+
+	// The dot separated path of the user ID in the JSON response, i.e. "uid" or "data.user.id"
+	UserIDPath string
+	// When set, the boolean at this path must be true for the response to be accepted
+	OkPath string
+
+	// How long a resolved user ID is reused for the same credentials. Zero disables caching
+	CacheTTL time.Duration
+}
+
+// Asks a backend endpoint who the user of a request is
+type BackendIdentityProvider struct {
+	config BackendIdentityConfig
+	cache  *identityCache
+}
+
+func NewBackendIdentityProvider(config BackendIdentityConfig) (*BackendIdentityProvider, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("Backend identity provider requires a URL")
+	}
+
+	if config.UserIDPath == "" {
+		return nil, fmt.Errorf("Backend identity provider requires a user ID path")
+	}
+
+	if config.Method == "" {
+		config.Method = "GET"
+	}
+
+	return &BackendIdentityProvider{
+		config: config,
+		cache:  newIdentityCache(config.CacheTTL),
+	}, nil
+}
+
+// The credentials forwarded to the backend make up the cache key
+func (p *BackendIdentityProvider) cacheKey(r *http.Request) string {
+	var parts []string
+
+	if p.config.ForwardCookies {
+		for _, cookie := range r.Cookies() {
+			parts = append(parts, cookie.Name+"="+cookie.Value)
+		}
+	}
+
+	for _, header := range p.config.ForwardHeaders {
+		if value := r.Header.Get(header); value != "" {
+			parts = append(parts, header+":"+value)
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+func (p *BackendIdentityProvider) GetUserID(r *http.Request) (string, error) {
+	key := p.cacheKey(r)
+	if userID, ok := p.cache.get(key); ok {
+		return userID, nil
+	}
+
+	userIDReq, err := http.NewRequest(p.config.Method, p.config.URL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Pass on the credentials from `r` to `userIDReq`
+	if p.config.ForwardCookies {
+		for _, cookie := range r.Cookies() {
+			userIDReq.AddCookie(cookie)
+		}
+	}
+
+	for _, header := range p.config.ForwardHeaders {
+		if value := r.Header.Get(header); value != "" {
+			userIDReq.Header.Set(header, value)
+		}
+	}
+
+	response, err := performRequestJSONValue(tool.PerformRequest, userIDReq)
+	if err != nil {
+		return "", err
+	}
+
+	if p.config.OkPath != "" {
+		ok, _ := lookupJSONPath(response, p.config.OkPath)
+		if ok != true {
+			return "", fmt.Errorf("Unable to retrieve the userID for this session")
+		}
+	}
+
+	userID, err := userIDAtJSONPath(response, p.config.UserIDPath)
+	if err != nil {
+		return "", err
+	}
+
+	p.cache.set(key, userID, time.Time{})
+
+	// Success!
+	return userID, nil
+}
+
+//
+// Trusted header from an upstream proxy
+//
+
+type HeaderIdentityConfig struct {
+	// The header holding the user ID, i.e. "X-Forwarded-User"
+	HeaderName string
+	// The IPs or CIDR ranges of the proxies allowed to set the `HeaderName`. Requests
+	// from anywhere else are refused, since any client could set the header otherwise
+	TrustedProxies []string
+}
+
+// Takes the user ID from a header set by an authenticating proxy in front of the firewall
+type HeaderIdentityProvider struct {
+	headerName     string
+	trustedProxies []*net.IPNet
+}
+
+func NewHeaderIdentityProvider(config HeaderIdentityConfig) (*HeaderIdentityProvider, error) {
+	if config.HeaderName == "" {
+		return nil, fmt.Errorf("Header identity provider requires a header name")
+	}
+
+	if len(config.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("Header identity provider requires at least one trusted proxy")
+	}
+
+	p := &HeaderIdentityProvider{headerName: config.HeaderName}
+
+	for _, proxy := range config.TrustedProxies {
+		// Treat a single IP as a range of exactly that IP
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		p.trustedProxies = append(p.trustedProxies, ipNet)
+	}
+
+	return p, nil
+}
+
+func (p *HeaderIdentityProvider) GetUserID(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(host)
+	trusted := false
+	for _, ipNet := range p.trustedProxies {
+		if remoteIP != nil && ipNet.Contains(remoteIP) {
+			trusted = true
+			break
+		}
+	}
+
+	if !trusted {
+		return "", fmt.Errorf("Request from %s is not from a trusted proxy", host)
+	}
+
+	userID := r.Header.Get(p.headerName)
+	if userID == "" {
+		return "", fmt.Errorf("Missing %s header", p.headerName)
+	}
+
+	return userID, nil
+}
+
+//
+// OAuth2 token introspection (RFC 7662)
+//
+
+type IntrospectionIdentityConfig struct {
+	// The https introspection endpoint of the authorization server
+	Endpoint string
+	// The credentials the firewall authenticates to the endpoint with
+	ClientID     string
+	ClientSecret string
+
+	// The response member holding the user ID. Defaults to "sub"
+	UserIDPath string
+	// The header carrying the token as "Bearer <token>". Defaults to "Authorization"
+	HeaderName string
+
+	// How long an active token is trusted without asking again. The
+	// `exp` of the token is never exceeded. Zero disables caching
+	CacheTTL time.Duration
+}
+
+// Resolves the user ID of an OAuth2 access token through token introspection
+type IntrospectionIdentityProvider struct {
+	config IntrospectionIdentityConfig
+	cache  *identityCache
+}
+
+func NewIntrospectionIdentityProvider(config IntrospectionIdentityConfig) (*IntrospectionIdentityProvider, error) {
+	if err := checkIntrospectionEndpoint(config.Endpoint); err != nil {
+		return nil, err
+	}
+
+	if config.UserIDPath == "" {
+		config.UserIDPath = "sub"
+	}
+
+	if config.HeaderName == "" {
+		config.HeaderName = "Authorization"
+	}
+
+	return &IntrospectionIdentityProvider{
+		config: config,
+		cache:  newIdentityCache(config.CacheTTL),
+	}, nil
+}
+
+// The token and client secret are sent to the endpoint, which must therefore be reached over https
+func checkIntrospectionEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("Token introspection requires an endpoint")
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("Malformed token introspection endpoint: %v", err)
+	}
+
+	if endpointURL.Scheme != "https" || endpointURL.Host == "" {
+		return fmt.Errorf("Token introspection endpoint must be an https URL: %s", endpoint)
+	}
+
+	return nil
+}
+
+func (p *IntrospectionIdentityProvider) GetUserID(r *http.Request) (string, error) {
+	// The token is the second part after the space of the header, i.e. "Bearer <token>"
+	fields := strings.Fields(r.Header.Get(p.config.HeaderName))
+	if len(fields) != 2 {
+		return "", fmt.Errorf("Missing or malformed %s header", p.config.HeaderName)
+	}
+	token := fields[1]
+
+	if userID, ok := p.cache.get(token); ok {
+		return userID, nil
+	}
+
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	introspectReq, err := http.NewRequest("POST", p.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	introspectReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	introspectReq.Header.Set("Accept", "application/json")
+
+	if p.config.ClientID != "" {
+		introspectReq.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	// The TLS certificate is checked, since the request carries the client secret
+	// and whoever answers it decides which user the token belongs to
+	response, err := performRequestJSONValue(tool.PerformVerifiedRequest, introspectReq)
+	if err != nil {
+		return "", err
+	}
+
+	// Inactive tokens carry no other members
+	if active, _ := lookupJSONPath(response, "active"); active != true {
+		return "", fmt.Errorf("OAuth2 token is not active")
+	}
+
+	userID, err := userIDAtJSONPath(response, p.config.UserIDPath)
+	if err != nil {
+		return "", err
+	}
+
+	// Never cache the token beyond its expiry
+	var notAfter time.Time
+	if exp, ok := lookupJSONPath(response, "exp"); ok {
+		if expNumber, ok := exp.(json.Number); ok {
+			if expUnix, err := expNumber.Int64(); err == nil {
+				notAfter = time.Unix(expUnix, 0)
+			}
+		}
+	}
+
+	p.cache.set(token, userID, notAfter)
+
+	// Success!
+	return userID, nil
+}
+
+//
+// JSON helpers
+//
+
+// Perform `req` with `perform` and decode its JSON response, keeping numbers as
+// `json.Number` so that large user IDs do not lose their precision as a float64
+func performRequestJSONValue(perform func(*http.Request) (*http.Response, error), req *http.Request) (interface{}, error) {
+	resp, err := perform(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Some sort of an error occurred at the server-side
+	if resp.StatusCode != http.StatusOK {
+		// The error text is inside of the `resp.Body`
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	// Success!
+	return value, nil
+}
+
+// Look up the dot separated `path` in the decoded JSON `value`. Numeric parts index into arrays
+func lookupJSONPath(value interface{}, path string) (interface{}, bool) {
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[part]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			value = v[idx]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// Retrieve the user ID at `path` of the decoded JSON `value`
+func userIDAtJSONPath(value interface{}, path string) (string, error) {
+	userID, ok := lookupJSONPath(value, path)
+	if !ok {
+		return "", fmt.Errorf("No userID found at %s", path)
+	}
+
+	return userIDFromJSON(userID)
+}
+
+// A user ID may either be a string or an integral JSON number
+func userIDFromJSON(userID interface{}) (string, error) {
+	switch v := userID.(type) {
+	case string:
+		if v != "" {
+			return v, nil
+		}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("Unable to decode userID: %v", userID)
+}
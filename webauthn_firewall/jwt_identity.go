@@ -0,0 +1,345 @@
+package webauthn_firewall
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/tool"
+)
+
+type JWTVerifierConfig struct {
+	// The accepted signing algorithms out of HS256, RS256 and ES256. Defaults to all three
+	Algorithms []string
+
+	// Exactly one source of verification keys should be set. The JWKS may either be the path
+	// of a local file or an https URL, whose server certificate must be valid
+	HMACSecretFile string
+	PublicKeyFile  string
+	JWKS           string
+
+	// When set, the `iss` and `aud` claims must match
+	Issuer   string
+	Audience string
+
+	// The claim holding the user ID. Defaults to "id"
+	UserIDClaim string
+	// The header carrying the token as "<scheme> <token>". Defaults to "Authorization"
+	HeaderName string
+
+	// How long a verified token is reused without checking its signature again.
+	// The `exp` of the token is never exceeded. Zero disables caching
+	CacheTTL time.Duration
+}
+
+// Verifies the JWTs of incoming requests and extracts the user ID from them
+type JWTVerifier struct {
+	algorithms map[string]bool
+
+	// A `keyID` of "" holds the key used for tokens without a `kid` header
+	keys map[string]interface{}
+
+	issuer      string
+	audience    string
+	userIDClaim string
+	headerName  string
+
+	cache *identityCache
+}
+
+func NewJWTVerifier(config JWTVerifierConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		algorithms:  make(map[string]bool),
+		keys:        make(map[string]interface{}),
+		issuer:      config.Issuer,
+		audience:    config.Audience,
+		userIDClaim: config.UserIDClaim,
+		headerName:  config.HeaderName,
+		cache:       newIdentityCache(config.CacheTTL),
+	}
+
+	if v.userIDClaim == "" {
+		v.userIDClaim = "id"
+	}
+
+	if v.headerName == "" {
+		v.headerName = "Authorization"
+	}
+
+	algorithms := config.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{"HS256", "RS256", "ES256"}
+	}
+
+	for _, alg := range algorithms {
+		switch alg {
+		case "HS256", "RS256", "ES256":
+			v.algorithms[alg] = true
+		default:
+			return nil, fmt.Errorf("Unsupported JWT signing algorithm: %s", alg)
+		}
+	}
+
+	var err error
+	switch {
+	case config.HMACSecretFile != "":
+		var secret []byte
+		secret, err = ioutil.ReadFile(config.HMACSecretFile)
+		v.keys[""] = []byte(strings.TrimSpace(string(secret)))
+	case config.PublicKeyFile != "":
+		err = v.loadPublicKey(config.PublicKeyFile)
+	case config.JWKS != "":
+		err = v.loadJWKS(config.JWKS)
+	default:
+		err = fmt.Errorf("No JWT verification key configured")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *JWTVerifier) loadPublicKey(filename string) error {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// Try the key types in turn
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pemBytes); err == nil {
+		v.keys[""] = key
+		return nil
+	}
+
+	if key, err := jwt.ParseECPublicKeyFromPEM(pemBytes); err == nil {
+		v.keys[""] = key
+		return nil
+	}
+
+	return fmt.Errorf("Unable to parse an RSA or EC public key from: %s", filename)
+}
+
+// Anyone on the network path could swap in their own keys of a JWKS served in the clear
+func checkJWKSLocation(location string) error {
+	if strings.HasPrefix(strings.ToLower(location), "http://") {
+		return fmt.Errorf("JWKS must be fetched over https: %s", location)
+	}
+
+	return nil
+}
+
+func (v *JWTVerifier) loadJWKS(location string) error {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+
+	if err := checkJWKSLocation(location); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(strings.ToLower(location), "https://") {
+		if err := tool.GetVerifiedRequestJSON(location, &jwks); err != nil {
+			return err
+		}
+	} else {
+		data, err := ioutil.ReadFile(location)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(data, &jwks); err != nil {
+			return err
+		}
+	}
+
+	decode := base64.RawURLEncoding.DecodeString
+
+	for _, jwk := range jwks.Keys {
+		// Skip keys which are not meant for signatures
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.Kty {
+		case "RSA":
+			n, err := decode(jwk.N)
+			if err != nil {
+				return err
+			}
+
+			e, err := decode(jwk.E)
+			if err != nil {
+				return err
+			}
+
+			v.keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+
+			x, err := decode(jwk.X)
+			if err != nil {
+				return err
+			}
+
+			y, err := decode(jwk.Y)
+			if err != nil {
+				return err
+			}
+
+			v.keys[jwk.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		case "oct":
+			k, err := decode(jwk.K)
+			if err != nil {
+				return err
+			}
+
+			v.keys[jwk.Kid] = k
+		}
+	}
+
+	if len(v.keys) == 0 {
+		return fmt.Errorf("No usable signing keys found in JWKS: %s", location)
+	}
+
+	return nil
+}
+
+// Select the verification key of the `token`, making sure it matches the signing algorithm
+func (v *JWTVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !v.algorithms[alg] {
+		return nil, fmt.Errorf("JWT signing algorithm not accepted: %s", alg)
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("No JWT verification key for kid: %s", kid)
+	}
+
+	// Prevent algorithm confusion, i.e. an RSA public key used as an HMAC secret
+	switch key.(type) {
+	case []byte:
+		if alg != "HS256" {
+			return nil, fmt.Errorf("JWT signing algorithm %s does not match an HMAC key", alg)
+		}
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return nil, fmt.Errorf("JWT signing algorithm %s does not match an RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			return nil, fmt.Errorf("JWT signing algorithm %s does not match an EC key", alg)
+		}
+	}
+
+	return key, nil
+}
+
+// Verify the JWT of `r` and return its claims
+func (v *JWTVerifier) Verify(r *http.Request) (jwt.MapClaims, error) {
+	// The token is the second part after the space of the header, i.e. "Bearer <token>"
+	fields := strings.Fields(r.Header.Get(v.headerName))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Missing or malformed %s header", v.headerName)
+	}
+
+	// Parsing checks the signature along with the `exp` and `nbf` claims. Keep
+	// the numbers as `json.Number` so that large user IDs keep their precision
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{UseJSONNumber: true}
+	_, err := parser.ParseWithClaims(fields[1], claims, v.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens which never expire are not accepted
+	if _, ok := claims["exp"].(json.Number); !ok {
+		return nil, fmt.Errorf("JWT is missing a numeric exp claim")
+	}
+
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return nil, fmt.Errorf("JWT issuer is not accepted")
+	}
+
+	if v.audience != "" && !verifyAudience(claims, v.audience) {
+		return nil, fmt.Errorf("JWT audience is not accepted")
+	}
+
+	// Success!
+	return claims, nil
+}
+
+// The `aud` claim may either be a single string or an array of them
+func verifyAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Retrieve the user ID of a verified JWT. This makes the `JWTVerifier` an `IdentityProvider`
+func (v *JWTVerifier) GetUserID(r *http.Request) (string, error) {
+	token := r.Header.Get(v.headerName)
+	if userID, ok := v.cache.get(token); ok {
+		return userID, nil
+	}
+
+	claims, err := v.Verify(r)
+	if err != nil {
+		return "", err
+	}
+
+	// Extract the `userID` from the JWT token
+	userID, err := userIDFromJSON(claims[v.userIDClaim])
+	if err != nil {
+		return "", fmt.Errorf("Unable to decode userID from JWT token")
+	}
+
+	// `Verify` made sure that the `exp` claim is a number
+	if exp, err := claims["exp"].(json.Number).Int64(); err == nil {
+		v.cache.set(token, userID, time.Unix(exp, 0))
+	}
+
+	// Success!
+	return userID, nil
+}
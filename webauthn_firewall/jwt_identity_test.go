@@ -0,0 +1,234 @@
+package webauthn_firewall
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testHMACSecret = "conduit-jwt-secret"
+
+type testJWTKeys struct {
+	dir string
+
+	rsaKey    *rsa.PrivateKey
+	rsaPubPEM []byte
+}
+
+func newTestJWTKeys(t *testing.T) *testJWTKeys {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testJWTKeys{
+		dir:       dir,
+		rsaKey:    rsaKey,
+		rsaPubPEM: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+	}
+}
+
+func (k *testJWTKeys) writeFile(t *testing.T, name string, data []byte) string {
+	filename := filepath.Join(k.dir, name)
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func signTestJWT(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	defer os.RemoveAll(keys.dir)
+
+	hmacVerifier, err := NewJWTVerifier(JWTVerifierConfig{
+		HMACSecretFile: keys.writeFile(t, "secret", []byte(testHMACSecret+"\n")),
+		Issuer:         "conduit",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Accepts every algorithm, so that only the key type rules out the confusion
+	rsaVerifier, err := NewJWTVerifier(JWTVerifierConfig{
+		Algorithms:    []string{"HS256", "RS256", "ES256"},
+		PublicKeyFile: keys.writeFile(t, "public.pem", keys.rsaPubPEM),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour).Unix()
+	expired := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name     string
+		verifier *JWTVerifier
+		token    string
+		wantErr  bool
+	}{
+		{
+			name:     "HS256",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS256, []byte(testHMACSecret), jwt.MapClaims{"id": 1, "iss": "conduit", "exp": expires}),
+		},
+		{
+			name:     "RS256",
+			verifier: rsaVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodRS256, keys.rsaKey, jwt.MapClaims{"id": 1, "exp": expires}),
+		},
+		{
+			name:     "HS256 signed with the RSA public key",
+			verifier: rsaVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS256, keys.rsaPubPEM, jwt.MapClaims{"id": 1, "exp": expires}),
+			wantErr:  true,
+		},
+		{
+			name:     "RS256 against an HMAC secret",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodRS256, keys.rsaKey, jwt.MapClaims{"id": 1, "iss": "conduit", "exp": expires}),
+			wantErr:  true,
+		},
+		{
+			name:     "none",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, jwt.MapClaims{"id": 1, "iss": "conduit", "exp": expires}),
+			wantErr:  true,
+		},
+		{
+			name:     "HS384",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS384, []byte(testHMACSecret), jwt.MapClaims{"id": 1, "iss": "conduit", "exp": expires}),
+			wantErr:  true,
+		},
+		{
+			name:     "wrong secret",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS256, []byte("another-secret"), jwt.MapClaims{"id": 1, "iss": "conduit", "exp": expires}),
+			wantErr:  true,
+		},
+		{
+			name:     "missing exp",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS256, []byte(testHMACSecret), jwt.MapClaims{"id": 1, "iss": "conduit"}),
+			wantErr:  true,
+		},
+		{
+			name:     "non-numeric exp",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS256, []byte(testHMACSecret), jwt.MapClaims{"id": 1, "iss": "conduit", "exp": "never"}),
+			wantErr:  true,
+		},
+		{
+			name:     "expired",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS256, []byte(testHMACSecret), jwt.MapClaims{"id": 1, "iss": "conduit", "exp": expired}),
+			wantErr:  true,
+		},
+		{
+			name:     "wrong issuer",
+			verifier: hmacVerifier,
+			token:    signTestJWT(t, jwt.SigningMethodHS256, []byte(testHMACSecret), jwt.MapClaims{"id": 1, "iss": "gogs", "exp": expires}),
+			wantErr:  true,
+		},
+		{
+			name:     "unknown kid",
+			verifier: rsaVerifier,
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"id": 1, "exp": expires})
+				token.Header["kid"] = "rotated"
+				signed, err := token.SignedString(keys.rsaKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signed
+			}(),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/user", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+
+			_, err := test.verifier.Verify(r)
+			if test.wantErr && err == nil {
+				t.Fatalf("Expected the token to be refused")
+			}
+			if !test.wantErr && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifier_GetUserID(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	defer os.RemoveAll(keys.dir)
+
+	verifier, err := NewJWTVerifier(JWTVerifierConfig{
+		Algorithms:     []string{"HS256"},
+		HMACSecretFile: keys.writeFile(t, "secret", []byte(testHMACSecret)),
+		UserIDClaim:    "id",
+		CacheTTL:       time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A user ID beyond the precision of a float64
+	token := signTestJWT(t, jwt.SigningMethodHS256, []byte(testHMACSecret), jwt.MapClaims{
+		"id":  9007199254740993,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/api/user", nil)
+		r.Header.Set("Authorization", "Token "+token)
+
+		userID, err := verifier.GetUserID(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if userID != "9007199254740993" {
+			t.Fatalf("User ID: got %s, want 9007199254740993", userID)
+		}
+	}
+}
+
+func TestNewJWTVerifier_JWKSOverHTTP(t *testing.T) {
+	_, err := NewJWTVerifier(JWTVerifierConfig{JWKS: "http://idp.example.com/.well-known/jwks.json"})
+	if err == nil || !strings.Contains(err.Error(), "https") {
+		t.Fatalf("Expected a JWKS over http to be refused, got: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package webauthn_firewall
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gorilla/mux"
+	log "unknwon.dev/clog/v2"
+)
+
+// Registers the routes of the firewall with `Secure`. The source is run again on every reload,
+// so it should read the rules afresh, i.e. from a configuration file. Returning an error
+// rejects the reload and keeps the running routes
+type RulesSource func(wfirewall *WebauthnFirewall) error
+
+// Set the `source` which `Reload` rebuilds the routes from. Routes registered
+// outside of the `source` are not part of the reloaded router
+func (wfirewall *WebauthnFirewall) SetRulesSource(source RulesSource) {
+	wfirewall.reloadLock.Lock()
+	defer wfirewall.reloadLock.Unlock()
+
+	wfirewall.rulesSource = source
+}
+
+// Rebuild the router from the rules source and swap it in atomically. In-flight requests,
+// and with them any webauthn ceremonies, are unaffected. On error the running router is kept
+func (wfirewall *WebauthnFirewall) Reload() (err error) {
+	wfirewall.reloadLock.Lock()
+	defer wfirewall.reloadLock.Unlock()
+
+	if wfirewall.rulesSource == nil {
+		return fmt.Errorf("No rules source to reload the routes from")
+	}
+
+	previousRouter := wfirewall.router
+	previousContextGetters := wfirewall.contextGetters
+
+	defer func() {
+		// `Secure` panics on malformed routes, which must not take down the running firewall
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+
+		// Restore the running state on any error
+		if err != nil {
+			wfirewall.router = previousRouter
+			wfirewall.contextGetters = previousContextGetters
+		}
+	}()
+
+	wfirewall.router = mux.NewRouter()
+	wfirewall.registerCoreRoutes()
+
+	if err = wfirewall.rulesSource(wfirewall); err != nil {
+		return err
+	}
+
+	// The router is only active once the firewall is serving
+	if wfirewall.serving {
+		wfirewall.registerCatchAll()
+		wfirewall.activeRouter.Store(wfirewall.router)
+	}
+
+	log.Info("Reloaded the firewall routes")
+
+	// Success!
+	return nil
+}
+
+func (wfirewall *WebauthnFirewall) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			log.Info("Received SIGHUP, reloading the firewall routes")
+			if err := wfirewall.Reload(); err != nil {
+				log.Error("Rejected the reloaded routes, keeping the running ones: %v", err)
+			}
+		}
+	}()
+}
+
+// Serve the admin endpoint, which is a plain HTTP listener separate from the proxy
+func (wfirewall *WebauthnFirewall) serveAdmin() {
+	adminRouter := mux.NewRouter()
+	adminRouter.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := wfirewall.Reload(); err != nil {
+			log.Error("Rejected the reloaded routes, keeping the running ones: %v", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Reloaded\n"))
+	}).Methods("POST")
+
+	log.Info("Starting up admin endpoint on: %s", wfirewall.adminAddress)
+	log.Error("Admin endpoint stopped: %v", http.ListenAndServe(wfirewall.adminAddress, adminRouter))
+}
@@ -0,0 +1,115 @@
+package webauthn_firewall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	log "unknwon.dev/clog/v2"
+)
+
+const (
+	// The largest request body a route inspects, unless configured otherwise
+	defaultMaxBodySize int64 = 10 << 20
+	// The size above which an inspected body is spilled to a temporary file, unless configured otherwise
+	defaultBodyMemoryLimit int64 = 1 << 20
+)
+
+// The error of a request body larger than its route allows
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (e bodyTooLargeError) Error() string {
+	return fmt.Sprintf("Request body exceeds the limit of %d bytes", e.limit)
+}
+
+// A buffered request body, which is kept in memory up to
+// a limit and in a temporary file beyond that
+type requestBody struct {
+	memory      []byte
+	file        *os.File
+	size        int64
+	memoryLimit int64
+}
+
+// Read the entire `body`, failing if it is larger than `maxSize`
+func bufferBody(body io.Reader, maxSize, memoryLimit int64) (*requestBody, error) {
+	// Read one byte past the limits to tell whether they were exceeded
+	memoryLimit = minInt64(memoryLimit, maxSize)
+	memory, err := ioutil.ReadAll(io.LimitReader(body, memoryLimit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(memory)) <= memoryLimit {
+		return &requestBody{memory: memory, size: int64(len(memory)), memoryLimit: memoryLimit}, nil
+	}
+
+	if memoryLimit == maxSize {
+		return nil, bodyTooLargeError{limit: maxSize}
+	}
+
+	// Spill the rest of the `body` to disk
+	file, err := ioutil.TempFile("", "webauthn-firewall-body-")
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := &requestBody{file: file, memoryLimit: memoryLimit}
+	buffered.size, err = io.Copy(file, io.MultiReader(
+		bytes.NewReader(memory),
+		io.LimitReader(body, maxSize-int64(len(memory))+1)))
+	if err != nil {
+		buffered.close()
+		return nil, err
+	}
+
+	if buffered.size > maxSize {
+		buffered.close()
+		return nil, bodyTooLargeError{limit: maxSize}
+	}
+
+	return buffered, nil
+}
+
+// A fresh reader over the entire body
+func (b *requestBody) reader() io.ReadCloser {
+	if b.file != nil {
+		return ioutil.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(b.memory))
+}
+
+// The entire body in memory. A body spilled to disk is refused rather than loaded back into
+// memory, which would defeat the memory limit. Use the `reader` to stream it instead
+func (b *requestBody) bytes() ([]byte, error) {
+	if b.file != nil {
+		return nil, bodyTooLargeError{limit: b.memoryLimit}
+	}
+
+	return b.memory, nil
+}
+
+// Remove the temporary file of a spilled body
+func (b *requestBody) close() {
+	if b.file == nil {
+		return
+	}
+
+	b.file.Close()
+	if err := os.Remove(b.file.Name()); err != nil {
+		log.Warn("Failed to remove spilled request body %s: %v", b.file.Name(), err)
+	}
+	b.file = nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
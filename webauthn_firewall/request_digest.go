@@ -0,0 +1,207 @@
+package webauthn_firewall
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// The extension carrying the digest of the request which an assertion approves. Unlike the
+// `txAuthSimple` text, it covers every field of the request, so that none can be altered
+const requestDigestExtension = "txRequestDigest"
+
+// The request field holding the assertion, which can never be part of what it signs
+const assertionField = "assertion"
+
+// Compute the canonical digest of a request. The canonical form is the method, the path with its
+// sorted query, the media type of the body and the normalized body, separated by newlines. Form and
+// JSON bodies are normalized by sorting their fields and removing the assertion. Multipart file
+// contents are replaced by their SHA-256. Any other body is taken as is. Raw bodies and multipart
+// files are streamed into the digest. Form and JSON bodies and the multipart values have to be
+// decoded in memory, so they are refused beyond `memoryLimit` bytes before being decoded
+func requestDigest(method string, requestURL *url.URL, contentType string, body io.Reader, memoryLimit int64) (string, error) {
+	hash := sha256.New()
+	io.WriteString(hash, strings.ToUpper(method))
+	io.WriteString(hash, "\n")
+	io.WriteString(hash, requestURL.EscapedPath())
+	if query := requestURL.Query(); len(query) != 0 {
+		io.WriteString(hash, "?")
+		io.WriteString(hash, query.Encode())
+	}
+	io.WriteString(hash, "\n")
+
+	if err := writeNormalizedBody(hash, contentType, body, memoryLimit); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Write the media type of a non-empty `body` followed by the normalized `body` itself
+func writeNormalizedBody(w io.Writer, contentType string, body io.Reader, memoryLimit int64) error {
+	// An empty body contributes nothing, whatever its content type
+	buffered := bufio.NewReader(body)
+	if _, err := buffered.Peek(1); err == io.EOF {
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Without a valid content type, the body cannot be normalized
+		io.WriteString(w, strings.TrimSpace(contentType))
+		io.WriteString(w, "\n")
+		_, err := io.Copy(w, buffered)
+		return err
+	}
+
+	// The backend may parse the same bytes differently by their media type, so it is part of the
+	// digest. The multipart boundary is not, since it only delimits the parts which are normalized
+	mediaParams := make(map[string]string, len(params))
+	for key, value := range params {
+		if key != "boundary" {
+			mediaParams[key] = value
+		}
+	}
+	io.WriteString(w, mime.FormatMediaType(mediaType, mediaParams))
+	io.WriteString(w, "\n")
+
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		raw, err := readLimited(buffered, memoryLimit)
+		if err != nil {
+			return err
+		}
+
+		values, err := url.ParseQuery(string(raw))
+		if err != nil {
+			return err
+		}
+		values.Del(assertionField)
+
+		// The `Encode` sorts the values by key
+		_, err = io.WriteString(w, values.Encode())
+		return err
+
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		raw, err := readLimited(buffered, memoryLimit)
+		if err != nil {
+			return err
+		}
+
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+
+		if object, ok := value.(jsonBody); ok {
+			delete(object, assertionField)
+		}
+
+		// The `Marshal` sorts the keys of every object
+		normalized, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(normalized)
+		return err
+
+	case mediaType == "multipart/form-data":
+		normalized, err := normalizeMultipart(buffered, params["boundary"], memoryLimit)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(normalized)
+		return err
+	}
+
+	_, err = io.Copy(w, buffered)
+	return err
+}
+
+// Normalize a multipart `body`, refusing it if its values other than files exceed `memoryLimit` bytes
+func normalizeMultipart(body io.Reader, boundary string, memoryLimit int64) ([]byte, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("Multipart body without a boundary")
+	}
+
+	values := make(url.Values)
+	remaining := memoryLimit
+	reader := multipart.NewReader(body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == assertionField {
+			continue
+		}
+
+		if part.FileName() == "" {
+			value, err := readLimited(part, remaining)
+			if _, ok := err.(bodyTooLargeError); ok {
+				return nil, bodyTooLargeError{limit: memoryLimit}
+			}
+			if err != nil {
+				return nil, err
+			}
+			remaining -= int64(len(value))
+
+			values.Add(name, string(value))
+			continue
+		}
+
+		// Files are represented by their name and content digest
+		hash := sha256.New()
+		if _, err := io.Copy(hash, part); err != nil {
+			return nil, err
+		}
+
+		values.Add(name, fmt.Sprintf("%s;%s", part.FileName(), hex.EncodeToString(hash.Sum(nil))))
+	}
+
+	return []byte(values.Encode()), nil
+}
+
+// The digest of the request `r` itself, to compare against the one the assertion approved
+func (r *ExtendedRequest) requestDigest() (string, error) {
+	body, err := r.bodyReader()
+	if err != nil {
+		return "", err
+	}
+
+	return requestDigest(r.Method, r.URL, r.Header.Get("Content-Type"), body, r.bodyMemoryLimit)
+}
+
+// Read all of `body` into memory, refusing it if it is larger than `limit`
+func readLimited(body io.Reader, limit int64) ([]byte, error) {
+	// Read one byte past the `limit` to tell whether it was exceeded
+	raw, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(raw)) > limit {
+		return nil, bodyTooLargeError{limit: limit}
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,181 @@
+package webauthn_firewall
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestDigest(t *testing.T) {
+	type request struct {
+		method      string
+		target      string
+		contentType string
+		body        string
+	}
+
+	multipart := func(boundary string) request {
+		return request{
+			method:      "POST",
+			target:      "/user/settings",
+			contentType: "multipart/form-data; boundary=" + boundary,
+			body: "--" + boundary + "\r\n" +
+				"Content-Disposition: form-data; name=\"name\"\r\n\r\n" +
+				"jake\r\n" +
+				"--" + boundary + "\r\n" +
+				"Content-Disposition: form-data; name=\"avatar\"; filename=\"jake.png\"\r\n" +
+				"Content-Type: image/png\r\n\r\n" +
+				"PNG\r\n" +
+				"--" + boundary + "--\r\n",
+		}
+	}
+
+	tests := []struct {
+		name     string
+		a, b     request
+		wantSame bool
+	}{
+		{
+			name:     "JSON key order and assertion",
+			a:        request{"PUT", "/api/user", "application/json", `{"user":{"email":"jake@jake.jake","bio":"hi"}}`},
+			b:        request{"PUT", "/api/user", "application/json", `{"assertion":"{}","user":{"bio":"hi","email":"jake@jake.jake"}}`},
+			wantSame: true,
+		},
+		{
+			name:     "form field order and assertion",
+			a:        request{"POST", "/user/settings", "application/x-www-form-urlencoded", "name=jake&email=jake%40jake.jake"},
+			b:        request{"POST", "/user/settings", "application/x-www-form-urlencoded", "email=jake%40jake.jake&assertion=%7B%7D&name=jake"},
+			wantSame: true,
+		},
+		{
+			name:     "query order",
+			a:        request{"DELETE", "/api/articles/a?x=1&y=2", "", ""},
+			b:        request{"DELETE", "/api/articles/a?y=2&x=1", "", ""},
+			wantSame: true,
+		},
+		{
+			name:     "media type case",
+			a:        request{"PUT", "/api/user", "application/json", `{"user":{}}`},
+			b:        request{"PUT", "/api/user", "Application/JSON", `{"user":{}}`},
+			wantSame: true,
+		},
+		{
+			name:     "empty body with and without a content type",
+			a:        request{"DELETE", "/api/articles/a", "", ""},
+			b:        request{"DELETE", "/api/articles/a", "application/json", ""},
+			wantSame: true,
+		},
+		{
+			name:     "multipart boundary",
+			a:        multipart("boundary-a"),
+			b:        multipart("boundary-b"),
+			wantSame: true,
+		},
+		{
+			name: "only the content type differs",
+			a:    request{"PUT", "/api/user", "application/json", `{"user":{"email":"jake@jake.jake"}}`},
+			b:    request{"PUT", "/api/user", "text/plain", `{"user":{"email":"jake@jake.jake"}}`},
+		},
+		{
+			name: "only the structured suffix differs",
+			a:    request{"PUT", "/api/user", "application/json", `{"user":{}}`},
+			b:    request{"PUT", "/api/user", "application/merge-patch+json", `{"user":{}}`},
+		},
+		{
+			name: "only the charset differs",
+			a:    request{"POST", "/api/user", "text/plain; charset=utf-8", "jake"},
+			b:    request{"POST", "/api/user", "text/plain; charset=utf-16", "jake"},
+		},
+		{
+			name: "form bytes sent as text",
+			a:    request{"POST", "/user/settings", "application/x-www-form-urlencoded", "name=jake"},
+			b:    request{"POST", "/user/settings", "text/plain", "name=jake"},
+		},
+		{
+			name: "method",
+			a:    request{"PUT", "/api/user", "application/json", `{"user":{}}`},
+			b:    request{"POST", "/api/user", "application/json", `{"user":{}}`},
+		},
+		{
+			name: "body value",
+			a:    request{"PUT", "/api/user", "application/json", `{"user":{"email":"jake@jake.jake"}}`},
+			b:    request{"PUT", "/api/user", "application/json", `{"user":{"email":"eve@eve.eve"}}`},
+		},
+	}
+
+	digest := func(t *testing.T, r request) string {
+		requestURL, err := url.Parse(r.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		digest, err := requestDigest(r.method, requestURL, r.contentType, strings.NewReader(r.body), defaultBodyMemoryLimit)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return digest
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := digest(t, test.a), digest(t, test.b)
+			if test.wantSame && a != b {
+				t.Errorf("Expected the same digest, got %s and %s", a, b)
+			}
+			if !test.wantSame && a == b {
+				t.Errorf("Expected different digests, got %s for both", a)
+			}
+		})
+	}
+}
+
+func TestRequestDigest_MemoryLimit(t *testing.T) {
+	const limit = 64
+
+	requestURL, err := url.Parse("/user/settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("a", limit)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{name: "form within the limit", contentType: "application/x-www-form-urlencoded", body: "name=jake"},
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "name=" + large, wantErr: true},
+		{name: "JSON", contentType: "application/json", body: `{"name":"` + large + `"}`, wantErr: true},
+		{
+			name:        "multipart values",
+			contentType: "multipart/form-data; boundary=b",
+			body: "--b\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n" + large[:limit/2] + "\r\n" +
+				"--b\r\nContent-Disposition: form-data; name=\"b\"\r\n\r\n" + large[:limit/2] + "a\r\n--b--\r\n",
+			wantErr: true,
+		},
+		{
+			name:        "multipart file",
+			contentType: "multipart/form-data; boundary=b",
+			body:        "--b\r\nContent-Disposition: form-data; name=\"a\"; filename=\"a.txt\"\r\n\r\n" + large + large + "\r\n--b--\r\n",
+		},
+		{name: "raw body", contentType: "text/plain", body: large + large},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := requestDigest("POST", requestURL, test.contentType, strings.NewReader(test.body), limit)
+
+			if !test.wantErr {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			if _, ok := err.(bodyTooLargeError); !ok {
+				t.Fatalf("Expected the body to be refused as too large, got: %v", err)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package webauthn_firewall
 
 import (
 	"fmt"
+	"net/http"
 )
 
 type FirewallSecureArgs interface{}
@@ -20,6 +21,32 @@ func NoOptions() customOptions {
 	return CustomOptions()
 }
 
+type userVerificationOption struct{}
+
+// Require the authenticator to verify the user (PIN or biometric) rather
+// than only checking for user presence on the webauthn secured route
+func RequireUserVerification() userVerificationOption {
+	return userVerificationOption{}
+}
+
+type requestBindingOption struct{}
+
+// Bind the assertion to a digest of the method, path and body of the request, rather than only
+// the authn text. Any field of the request not shown in the text can then not be altered either
+func BindRequestBody() requestBindingOption {
+	return requestBindingOption{}
+}
+
+type maxBodySizeOption struct {
+	limit int64
+}
+
+// Limit the size of the request bodies which the route inspects to `limit` bytes, in place of
+// the `MaxBodySize` of the firewall. Larger bodies are refused with a 413 status
+func MaxBodySize(limit int64) maxBodySizeOption {
+	return maxBodySizeOption{limit: limit}
+}
+
 func (wfirewall *WebauthnFirewall) Secure(method, url string, handleFn HandlerFnType, optArgs ...FirewallSecureArgs) {
 	// Set the default `options` according to the `wfirewall.supplyOptions` flag
 	options := NoOptions()
@@ -27,11 +54,21 @@ func (wfirewall *WebauthnFirewall) Secure(method, url string, handleFn HandlerFn
 		options = CustomOptions(method)
 	}
 
+	requireUserVerification := false
+	bindRequestBody := false
+	var maxBodySize int64
+
 	// Run through the `optArgs` and process them
 	for _, arg := range optArgs {
 		switch arg.(type) {
 		case customOptions:
 			options = arg.(customOptions)
+		case userVerificationOption:
+			requireUserVerification = true
+		case requestBindingOption:
+			bindRequestBody = true
+		case maxBodySizeOption:
+			maxBodySize = arg.(maxBodySizeOption).limit
 		default:
 			panic(fmt.Sprintf("Unknown option argument in Secure: %v", arg))
 		}
@@ -43,6 +80,33 @@ func (wfirewall *WebauthnFirewall) Secure(method, url string, handleFn HandlerFn
 		wfirewall.router.HandleFunc(url, wfirewall.wrapWithExtendedReq(optionsHandler)).Methods("OPTIONS")
 	}
 
+	// Mark the requests of this route as requiring user verification
+	if requireUserVerification {
+		secureFn := handleFn
+		handleFn = func(w http.ResponseWriter, r *ExtendedRequest) {
+			r.requireUserVerification = true
+			secureFn(w, r)
+		}
+	}
+
+	// Mark the requests of this route as binding the assertion to the request
+	if bindRequestBody {
+		bindFn := handleFn
+		handleFn = func(w http.ResponseWriter, r *ExtendedRequest) {
+			r.bindRequestBody = true
+			bindFn(w, r)
+		}
+	}
+
+	// Apply the body size limit of this route before anything inspects the body
+	if maxBodySize > 0 {
+		limitFn := handleFn
+		handleFn = func(w http.ResponseWriter, r *ExtendedRequest) {
+			r.maxBodySize = maxBodySize
+			limitFn(w, r)
+		}
+	}
+
 	// Register the `url` and `method` with the HTTP router
 	wfirewall.router.HandleFunc(url, wfirewall.wrapWithExtendedReq(handleFn)).Methods(method)
 }
@@ -0,0 +1,189 @@
+package webauthn_firewall
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
+
+	"webauthn/webauthn"
+	"webauthn_utils/session"
+)
+
+// Keeps the `webauthn.SessionData` of a ceremony between its begin and finish requests
+type SessionStore interface {
+	SaveWebauthnSession(key string, data *webauthn.SessionData, r *http.Request, w http.ResponseWriter) error
+	GetWebauthnSession(key string, r *http.Request) (webauthn.SessionData, error)
+}
+
+// Where the session data of the webauthn ceremonies is kept
+type SessionStoreType int
+
+const (
+	// In an encrypted cookie on the client, which needs a session key
+	SessionStoreCookie SessionStoreType = iota
+	// In the memory of this process, for firewalls running as a single replica
+	SessionStoreMemory
+	// In the credential database, which is shared by every replica
+	SessionStoreDatabase
+)
+
+type SessionConfig struct {
+	Store SessionStoreType
+
+	// The key encrypting the cookies of `SessionStoreCookie`. It is
+	// read from the `SESSION_KEY` environment variable when unset
+	Key []byte
+
+	// How long the server-side session data lives. Defaults to 5 minutes
+	TTL time.Duration
+}
+
+// The cookie holding the ID of a server-side session
+const sessionCookieName = "webauthn-session-id"
+
+const defaultSessionTTL = 5 * time.Minute
+
+// Make sure the cookie based `session.Store` implements the `SessionStore` interface
+var _ SessionStore = (*session.Store)(nil)
+
+// Decode the hex session key held by the `SESSION_KEY` environment variable
+func SessionKeyFromEnv() ([]byte, error) {
+	sessionKey, err := hex.DecodeString(os.Getenv(ENV_SESSION_KEY))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode session key env variable: %v", err)
+	}
+
+	return sessionKey, nil
+}
+
+// Create the `SessionStore` selected by `config`. The `storage` backs the `SessionStoreDatabase`
+func newSessionStore(config SessionConfig, storage db.SessionStorage) (SessionStore, error) {
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+
+	switch config.Store {
+	case SessionStoreCookie:
+		sessionKey := config.Key
+		if len(sessionKey) == 0 {
+			var err error
+			sessionKey, err = SessionKeyFromEnv()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(sessionKey) < session.DefaultEncryptionKeyLength {
+			return nil, fmt.Errorf("Session key not long enough: %d < %d",
+				len(sessionKey), session.DefaultEncryptionKeyLength)
+		}
+
+		cookieStore, err := session.NewStore(sessionKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create webauthn session store: %v", err)
+		}
+
+		return cookieStore, nil
+
+	case SessionStoreMemory:
+		return &serverSessionStore{storage: db.NewMemorySessionStorage(), ttl: ttl}, nil
+
+	case SessionStoreDatabase:
+		return &serverSessionStore{storage: storage, ttl: ttl}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown session store: %d", config.Store)
+}
+
+// Keeps the session data on the server. The client only holds a random session ID in a cookie
+type serverSessionStore struct {
+	storage db.SessionStorage
+	ttl     time.Duration
+}
+
+// The storage key of the `key` session data of the session `sessionID`. The `sessionID` is hashed,
+// so that the contents of the storage are not enough to take over the sessions. The empty `key`
+// marks that the `sessionID` itself was issued by this store
+func (s *serverSessionStore) storageKey(sessionID, key string) string {
+	hashedID := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(hashedID[:]) + ":" + key
+}
+
+// The session ID of the client if this store issued it and it is still live, otherwise a fresh random one.
+// Taking up any ID sent by the client would let an attacker plant a known ID in the cookie of its victim
+func (s *serverSessionStore) sessionID(r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		if _, err := s.storage.LoadSession(s.storageKey(cookie.Value, "")); err == nil {
+			return cookie.Value, nil
+		}
+	}
+
+	rawID := make([]byte, 32)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(rawID), nil
+}
+
+func (s *serverSessionStore) SaveWebauthnSession(key string, data *webauthn.SessionData, r *http.Request, w http.ResponseWriter) error {
+	marshaledData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	sessionID, err := s.sessionID(r)
+	if err != nil {
+		return err
+	}
+
+	// Keep the session ID live for as long as its newest session data
+	expires := time.Now().Add(s.ttl)
+	if err := s.storage.SaveSession(s.storageKey(sessionID, ""), []byte{}, expires); err != nil {
+		return err
+	}
+
+	if err := s.storage.SaveSession(s.storageKey(sessionID, key), marshaledData, expires); err != nil {
+		return err
+	}
+
+	// The frontend is on a different origin than the firewall
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		MaxAge:   int(s.ttl.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+
+	// Success!
+	return nil
+}
+
+func (s *serverSessionStore) GetWebauthnSession(key string, r *http.Request) (webauthn.SessionData, error) {
+	var sessionData webauthn.SessionData
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return sessionData, fmt.Errorf("Missing webauthn session cookie")
+	}
+
+	marshaledData, err := s.storage.LoadSession(s.storageKey(cookie.Value, key))
+	if err != nil {
+		return sessionData, err
+	}
+
+	err = json.Unmarshal(marshaledData, &sessionData)
+	return sessionData, err
+}
@@ -0,0 +1,62 @@
+package webauthn_firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
+
+	"webauthn/webauthn"
+)
+
+// Save the `key` session data with the `sessionID` cookie, if any, returning the session ID of the response
+func saveTestSession(t *testing.T, store SessionStore, key, sessionID string) string {
+	r := httptest.NewRequest("POST", "/webauthn/begin_register", nil)
+	if sessionID != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+	}
+
+	w := httptest.NewRecorder()
+	if err := store.SaveWebauthnSession(key, &webauthn.SessionData{Challenge: key}, r, w); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie.Value
+		}
+	}
+
+	t.Fatalf("Missing session cookie")
+	return ""
+}
+
+func TestServerSessionStore_SessionID(t *testing.T) {
+	store := &serverSessionStore{storage: db.NewMemorySessionStorage(), ttl: time.Minute}
+
+	// An ID which this store never issued is replaced
+	planted := "attacker-chosen-session-id"
+	sessionID := saveTestSession(t, store, "registration", planted)
+	if sessionID == planted {
+		t.Fatalf("Expected the planted session ID to be replaced")
+	}
+
+	// An ID which this store issued is kept, along with its earlier session data
+	if reused := saveTestSession(t, store, "authentication", sessionID); reused != sessionID {
+		t.Fatalf("Expected the session ID %s to be reused, got %s", sessionID, reused)
+	}
+
+	r := httptest.NewRequest("POST", "/webauthn/finish_register", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+	for _, key := range []string{"registration", "authentication"} {
+		sessionData, err := store.GetWebauthnSession(key, r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sessionData.Challenge != key {
+			t.Fatalf("Challenge: got %s, want %s", sessionData.Challenge, key)
+		}
+	}
+}
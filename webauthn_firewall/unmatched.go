@@ -0,0 +1,139 @@
+package webauthn_firewall
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	log "unknwon.dev/clog/v2"
+)
+
+// How requests which match none of the secured routes are handled
+type UnmatchedPolicy int
+
+const (
+	// Proxy the request onward to the backend
+	UnmatchedAllow UnmatchedPolicy = iota
+	// Refuse the request
+	UnmatchedDeny
+	// Require a webauthn assertion over the method and path of the request
+	UnmatchedAssert
+)
+
+// The methods which the `UnmatchedRoutesPolicy` applies to when none are listed
+var defaultUnmatchedMethods = []string{"POST", "PUT", "PATCH", "DELETE"}
+
+// A pattern of routes, i.e. those which the `UnmatchedRoutesPolicy` always proxies
+type RoutePattern struct {
+	// The method of the route, where "" or "*" matches every method
+	Method string
+	// A `path.Match` pattern such as "/api/*/comments". A trailing "/**"
+	// matches everything under the prefix, i.e. "/static/**"
+	Path string
+}
+
+type UnmatchedRoutesPolicy struct {
+	Policy UnmatchedPolicy
+
+	// The methods the `Policy` applies to. Unmatched requests of any other
+	// method are allowed. Defaults to every method except GET, HEAD and OPTIONS
+	Methods []string
+
+	Exemptions []RoutePattern
+
+	// The authn text of `UnmatchedAssert`, formatted with the method and path
+	// of the request. Defaults to "Confirm request: %s %s"
+	AuthnText string
+}
+
+func (e RoutePattern) matches(r *http.Request) bool {
+	if e.Method != "" && e.Method != "*" && !strings.EqualFold(e.Method, r.Method) {
+		return false
+	}
+
+	if strings.HasSuffix(e.Path, "/**") {
+		prefix := strings.TrimSuffix(e.Path, "**")
+		return strings.HasPrefix(r.URL.Path, prefix) || r.URL.Path == strings.TrimSuffix(prefix, "/")
+	}
+
+	matched, err := path.Match(e.Path, r.URL.Path)
+	return err == nil && matched
+}
+
+// Check the exemption patterns, since a malformed one would otherwise never match
+func (p UnmatchedRoutesPolicy) validate() error {
+	if p.Policy < UnmatchedAllow || p.Policy > UnmatchedAssert {
+		return fmt.Errorf("Unknown unmatched routes policy: %d", p.Policy)
+	}
+
+	for _, exemption := range p.Exemptions {
+		if err := exemption.validate(); err != nil {
+			return fmt.Errorf("Malformed route exemption %s: %v", exemption.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// Check the `Path` pattern, since a malformed one would otherwise never match
+func (e RoutePattern) validate() error {
+	_, err := path.Match(e.Path, "/")
+	return err
+}
+
+// Select the policy applying to the unmatched request `r`
+func (p UnmatchedRoutesPolicy) policyFor(r *http.Request) UnmatchedPolicy {
+	if p.Policy == UnmatchedAllow {
+		return UnmatchedAllow
+	}
+
+	methods := p.Methods
+	if len(methods) == 0 {
+		methods = defaultUnmatchedMethods
+	}
+
+	applies := false
+	for _, method := range methods {
+		if strings.EqualFold(method, r.Method) {
+			applies = true
+			break
+		}
+	}
+
+	if !applies {
+		return UnmatchedAllow
+	}
+
+	for _, exemption := range p.Exemptions {
+		if exemption.matches(r) {
+			return UnmatchedAllow
+		}
+	}
+
+	return p.Policy
+}
+
+// Handle the requests which fall through to the catch-all route
+func (wfirewall *WebauthnFirewall) unmatchedRequestHandler() HandlerFnType {
+	authnText := wfirewall.unmatchedRoutes.AuthnText
+	if authnText == "" {
+		authnText = "Confirm request: %s %s"
+	}
+
+	assertFn := wfirewall.webauthnSecure(func(r *ExtendedRequest) string {
+		return fmt.Sprintf(authnText, r.Method, r.URL.Path)
+	})
+
+	return func(w http.ResponseWriter, r *ExtendedRequest) {
+		switch wfirewall.unmatchedRoutes.policyFor(r.Request) {
+		case UnmatchedDeny:
+			log.Warn("Denied unmatched request: %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Route is not permitted by the firewall", http.StatusForbidden)
+		case UnmatchedAssert:
+			assertFn(w, r)
+		default:
+			wfirewall.proxyRequest(w, r)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package webauthn_firewall
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -11,12 +12,64 @@ import (
 	"github.com/JSmith-BitFlipper/webauthn-firewall-proxy/db"
 
 	"webauthn/protocol"
+	"webauthn/webauthn"
 )
 
 func logRequest(r *ExtendedRequest) {
 	log.Info("%s:\t%s", r.Request.Method, r.Request.URL)
 }
 
+// Format the 16 byte `aaguid` in its canonical UUID form
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", aaguid[0:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:16])
+}
+
+// Check that the UV flag is set in the authenticator data of the `assertion`
+func checkUserVerified(assertion string) error {
+	parsed, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(assertion))
+	if err != nil {
+		return err
+	}
+
+	if !parsed.Response.AuthenticatorData.Flags.UserVerified() {
+		return fmt.Errorf("User verification is required for this operation")
+	}
+
+	return nil
+}
+
+// The backup eligibility (BE) bit of the authenticator data flags
+const flagBackupEligible protocol.AuthenticatorFlags = 1 << 3
+
+// Extract the transports and the backup eligibility of a registration `credentials` response
+func parseCredentialMetadata(credentials string) (db.CredentialMetadata, error) {
+	var metadata db.CredentialMetadata
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(credentials))
+	if err != nil {
+		return metadata, err
+	}
+	metadata.BackupEligible = parsed.Response.AttestationObject.AuthData.Flags&flagBackupEligible != 0
+
+	// The transports are reported by `getTransports()` on the client
+	var response struct {
+		Response struct {
+			Transports []string `json:"transports"`
+		} `json:"response"`
+	}
+	err = json.Unmarshal([]byte(credentials), &response)
+	if err != nil {
+		return metadata, err
+	}
+	metadata.Transports = response.Response.Transports
+
+	return metadata, nil
+}
+
 func (wfirewall *WebauthnFirewall) prepareJSONResponse(w http.ResponseWriter) {
 	// Set the header info
 	w.Header().Set("Access-Control-Allow-Origin", wfirewall.FrontendAddress)
@@ -72,18 +125,48 @@ func CheckWebauthnAssertion(
 	expectedExtensions protocol.AuthenticationExtensions,
 	assertion string) error {
 
-	// Get a `webauthnUser` from the input `query`
-	wuser, err := db.WebauthnStore.GetWebauthnUser(query)
+	// Verify against the firewall which the request `r` was routed by
+	wfirewall := r.firewall
+
+	// Load the session data
+	sessionData, err := wfirewall.sessionStore.GetWebauthnSession("authentication", r.Request)
 	if err != nil {
 		return err
 	}
 
-	// Load the session data
-	sessionData, err := sessionStore.GetWebauthnSession("authentication", r.Request)
+	return wfirewall.verifyAssertion(r, query, sessionData, expectedExtensions, assertion)
+}
+
+// Verify the `assertion` of the user selected by `query` against the `sessionData` of the ceremony
+func (wfirewall *WebauthnFirewall) verifyAssertion(
+	r *ExtendedRequest,
+	query db.WebauthnQuery,
+	sessionData webauthn.SessionData,
+	expectedExtensions protocol.AuthenticationExtensions,
+	assertion string) error {
+
+	// Refuse a challenge which was already used, even if its session cookie is still valid.
+	// The challenge is consumed up front, so that concurrent replays cannot both pass
+	err := wfirewall.consumeChallenge(sessionData)
 	if err != nil {
 		return err
 	}
 
+	// Get a `webauthnUser` from the input `query`. The `wuser` holds every
+	// credential registered to the user, any one of which may sign the `assertion`
+	wuser, err := wfirewall.store.GetWebauthnUser(query)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the user was verified, not only present, if the route requires it
+	if r.requireUserVerification {
+		err = checkUserVerified(assertion)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Verify the transaction authentication text
 	var verifyTxAuthSimple protocol.ExtensionsVerifier = func(_, clientDataExtensions protocol.AuthenticationExtensions) error {
 		if !reflect.DeepEqual(expectedExtensions, clientDataExtensions) {
@@ -96,10 +179,28 @@ func CheckWebauthnAssertion(
 		return nil
 	}
 
-	// TODO: In an actual implementation, we should perform additional checks on
-	// the returned 'credential', i.e. check 'credential.Authenticator.CloneWarning'
-	// and then increment the credentials counter
-	_, err = webauthnAPI.FinishLogin(wuser, sessionData, verifyTxAuthSimple, assertion)
+	credential, err := wfirewall.webauthnAPI.FinishLogin(wuser, sessionData, verifyTxAuthSimple, assertion)
+	if err != nil {
+		return err
+	}
+
+	// The authenticator reported a sign counter which did not increase
+	if credential.Authenticator.CloneWarning {
+		rejected := wfirewall.cloneWarningPolicy == CloneWarningReject
+
+		// Record the event so that it can be investigated later
+		err = wfirewall.store.RecordCloneWarning(wuser, credential, rejected)
+		if err != nil {
+			return err
+		}
+
+		if rejected {
+			return fmt.Errorf("Sign counter regression detected, the authenticator may be cloned")
+		}
+	}
+
+	// Persist the new sign counter of the `credential`
+	err = wfirewall.store.UpdateSignCount(credential)
 	if err != nil {
 		return err
 	}
@@ -125,7 +226,7 @@ func (wfirewall *WebauthnFirewall) webauthnSecure(getAuthnText func(*ExtendedReq
 		}
 
 		// See if the user has webauthn enabled
-		isEnabled := db.WebauthnStore.IsUserEnabled(db.QueryByUserID(userID))
+		isEnabled := wfirewall.store.IsUserEnabled(db.QueryByUserID(userID))
 
 		// Perform a webauthn check if webauthn is enabled for this user
 		if isEnabled {
@@ -147,6 +248,15 @@ func (wfirewall *WebauthnFirewall) webauthnSecure(getAuthnText func(*ExtendedReq
 			extensions := make(protocol.AuthenticationExtensions)
 			extensions["txAuthSimple"] = authnText
 
+			// Have the assertion cover the entire request as well
+			if r.bindRequestBody || wfirewall.bindRequestBody {
+				digest, err := r.requestDigest()
+				if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {
+					return
+				}
+				extensions[requestDigestExtension] = digest
+			}
+
 			// Check the webauthn assertion for this operation
 			err = CheckWebauthnAssertion(r, db.QueryByUserID(userID), extensions, assertion)
 			if r.HandleError_WithStatus(w, err, http.StatusBadRequest) {